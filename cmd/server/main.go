@@ -2,6 +2,9 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/exogmi/gossip/config"
@@ -28,11 +31,29 @@ func main() {
 	// Initialize state components
 	userManager := state.NewUserManager()
 	messageStore := state.NewMessageStore(1000) // Store up to 1000 messages per target
-	stateManager := state.NewStateManager(userManager, messageStore, "irc.gossip.local", cfg.Verbosity)
+	stateManager := state.NewStateManager(userManager, messageStore, cfg)
 
 	// Start periodic cleanup of old messages
 	messageStore.StartPeriodicCleanup(1 * time.Hour)
 
+	// Reload the MOTD and reserved nicknames on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := stateManager.MOTD.Load(); err != nil {
+				log.Printf("Failed to reload MOTD: %v", err)
+			} else {
+				log.Printf("MOTD reloaded")
+			}
+			if err := stateManager.ReservedNicks.Load(); err != nil {
+				log.Printf("Failed to reload reserved nicknames: %v", err)
+			} else {
+				log.Printf("Reserved nicknames reloaded")
+			}
+		}
+	}()
+
 	if cfg.UseSSL {
 		log.Printf("SSL support enabled on port %d", cfg.SSLPort)
 	}
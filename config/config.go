@@ -3,6 +3,7 @@ package config
 import (
 	"flag"
 	"fmt"
+	"time"
 )
 
 // VerbosityLevel represents the logging verbosity level
@@ -16,13 +17,54 @@ const (
 
 // Config holds the server configuration
 type Config struct {
-	Host         string
-	Port         int
-	SSLPort      int
-	SSLCertFile  string
-	SSLKeyFile   string
-	Verbosity    VerbosityLevel
-	UseSSL       bool
+	Host          string
+	Port          int
+	SSLPort       int
+	SSLCertFile   string
+	SSLKeyFile    string
+	Verbosity     VerbosityLevel
+	UseSSL        bool
+	ServerName    string
+	DefaultTopic  string // Topic given to new channels, "{channel}" is replaced by the channel name
+	AccountHost   string // Host shown for users logged in to an account, "{account}" is replaced by the account name
+	MOTDFile      string
+	AdminName     string
+	AdminLocation string
+	AdminEmail    string
+	NetworkName   string
+	NickLength    int // Maximum nickname length (NICKLEN)
+	ChannelLength int // Maximum channel name length (CHANNELLEN)
+	TopicLength   int // Maximum topic length (TOPICLEN)
+	KickLength    int // Maximum kick reason length (KICKLEN)
+	AwayLength    int // Maximum away message length (AWAYLEN)
+	NameLength    int // Maximum realname length (NAMELEN)
+	MaxChannels   int // Maximum number of channels a user can be in (CHANLIMIT)
+	MonitorLimit  int // Maximum number of nicknames a user can MONITOR
+	MaxTargets    int // Maximum number of targets of a PRIVMSG, NOTICE or KICK (MAXTARGETS)
+
+	// Casemapping is how nicknames and channel names are compared regardless
+	// of case: ascii, rfc1459 or strict-rfc1459
+	Casemapping string
+
+	// NickPolicy is the set of nicknames allowed: rfc2812, strict or relaxed
+	NickPolicy string
+
+	// UTF8Only rejects input that is not valid UTF-8 (UTF8ONLY)
+	UTF8Only bool
+
+	// LegacyEncoding is the encoding the input of connections that do not
+	// send UTF-8 is decoded from: latin1, cp1252, or "" to leave it undecoded
+	LegacyEncoding string
+
+	// ReservedNicksFile lists nickname masks no user may take, with reasons
+	ReservedNicksFile string
+
+	// MonitorDetachedOnline reports users with no connected client as online
+	// to MONITOR, since they keep receiving messages
+	MonitorDetachedOnline bool
+
+	Password            string        // Server password clients must send with PASS
+	RegistrationTimeout time.Duration // Time a client has to complete registration
 }
 
 // Load loads the configuration from command-line flags
@@ -35,6 +77,31 @@ func Load() (*Config, error) {
 	flag.StringVar(&cfg.SSLCertFile, "ssl-cert", "", "Path to SSL certificate file")
 	flag.StringVar(&cfg.SSLKeyFile, "ssl-key", "", "Path to SSL key file")
 	flag.BoolVar(&cfg.UseSSL, "use-ssl", false, "Enable SSL support")
+	flag.StringVar(&cfg.ServerName, "server-name", "irc.gossip.local", "Name the server announces to clients")
+	flag.StringVar(&cfg.DefaultTopic, "default-topic", "", "Topic for new channels ({channel} is replaced by the channel name)")
+	flag.StringVar(&cfg.AccountHost, "account-host", "", "Host shown for users logged in to an account ({account} is replaced by the account name)")
+	flag.StringVar(&cfg.MOTDFile, "motd-file", "", "Path to the message of the day file (reloaded on SIGHUP)")
+	flag.StringVar(&cfg.AdminName, "admin-name", "", "Server administrator name shown by ADMIN")
+	flag.StringVar(&cfg.AdminLocation, "admin-location", "", "Server location shown by ADMIN")
+	flag.StringVar(&cfg.AdminEmail, "admin-email", "", "Administrator contact e-mail shown by ADMIN")
+	flag.StringVar(&cfg.NetworkName, "network-name", "Gossip", "Network name advertised to clients")
+	flag.StringVar(&cfg.Casemapping, "casemapping", "rfc1459", "Casemapping of nicknames and channel names (ascii, rfc1459, strict-rfc1459)")
+	flag.StringVar(&cfg.NickPolicy, "nick-policy", "rfc2812", "Characters allowed in nicknames (rfc2812, strict, relaxed)")
+	flag.BoolVar(&cfg.UTF8Only, "utf8-only", false, "Reject input that is not valid UTF-8")
+	flag.StringVar(&cfg.LegacyEncoding, "legacy-encoding", "", "Encoding to decode input that is not valid UTF-8 from (latin1, cp1252)")
+	flag.StringVar(&cfg.ReservedNicksFile, "reserved-nicks", "", "Path to a file of reserved nickname masks and reasons (reloaded on SIGHUP)")
+	flag.IntVar(&cfg.NickLength, "nick-length", 30, "Maximum nickname length")
+	flag.IntVar(&cfg.ChannelLength, "channel-length", 50, "Maximum channel name length")
+	flag.IntVar(&cfg.TopicLength, "topic-length", 390, "Maximum topic length")
+	flag.IntVar(&cfg.KickLength, "kick-length", 255, "Maximum kick reason length")
+	flag.IntVar(&cfg.AwayLength, "away-length", 200, "Maximum away message length")
+	flag.IntVar(&cfg.NameLength, "name-length", 128, "Maximum realname length")
+	flag.IntVar(&cfg.MaxChannels, "max-channels", 50, "Maximum number of channels a user can join")
+	flag.IntVar(&cfg.MonitorLimit, "monitor-limit", 100, "Maximum number of nicknames a user can MONITOR")
+	flag.IntVar(&cfg.MaxTargets, "max-targets", 4, "Maximum number of targets of a PRIVMSG, NOTICE or KICK")
+	flag.BoolVar(&cfg.MonitorDetachedOnline, "monitor-detached-online", true, "Report users with no connected client as online to MONITOR")
+	flag.StringVar(&cfg.Password, "password", "", "Server password clients must send with PASS")
+	flag.DurationVar(&cfg.RegistrationTimeout, "registration-timeout", time.Minute, "Time a client has to complete registration")
 	verbosity := flag.String("verbosity", "info", "Logging verbosity (info, debug, trace)")
 
 	flag.Parse()
@@ -50,6 +117,44 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("invalid verbosity level: %s", *verbosity)
 	}
 
+	switch cfg.Casemapping {
+	case "ascii", "rfc1459", "strict-rfc1459":
+	default:
+		return nil, fmt.Errorf("invalid casemapping: %s", cfg.Casemapping)
+	}
+
+	switch cfg.NickPolicy {
+	case "rfc2812", "strict", "relaxed":
+	default:
+		return nil, fmt.Errorf("invalid nick-policy: %s", cfg.NickPolicy)
+	}
+
+	switch cfg.LegacyEncoding {
+	case "", "latin1", "cp1252":
+	default:
+		return nil, fmt.Errorf("invalid legacy-encoding: %s", cfg.LegacyEncoding)
+	}
+
+	for name, limit := range map[string]int{
+		"nick-length":    cfg.NickLength,
+		"channel-length": cfg.ChannelLength,
+		"topic-length":   cfg.TopicLength,
+		"kick-length":    cfg.KickLength,
+		"away-length":    cfg.AwayLength,
+		"name-length":    cfg.NameLength,
+		"max-channels":   cfg.MaxChannels,
+		"monitor-limit":  cfg.MonitorLimit,
+		"max-targets":    cfg.MaxTargets,
+	} {
+		if limit < 1 {
+			return nil, fmt.Errorf("invalid %s: %d", name, limit)
+		}
+	}
+
+	if cfg.RegistrationTimeout <= 0 {
+		return nil, fmt.Errorf("invalid registration-timeout: %s", cfg.RegistrationTimeout)
+	}
+
 	if cfg.UseSSL && (cfg.SSLCertFile == "" || cfg.SSLKeyFile == "") {
 		return nil, fmt.Errorf("SSL support enabled but certificate or key file not provided")
 	}
@@ -2,4 +2,7 @@ module github.com/exogmi/gossip
 
 go 1.20
 
-require github.com/google/uuid v1.3.0
+require (
+	github.com/google/uuid v1.3.0
+	golang.org/x/crypto v0.31.0
+)
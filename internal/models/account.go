@@ -0,0 +1,48 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxPasswordLength is the longest password bcrypt can hash, in bytes
+const MaxPasswordLength = 72
+
+var ErrPasswordTooLong = errors.New("password too long")
+
+// Account represents a registered user account
+type Account struct {
+	Name         string
+	PasswordHash []byte // bcrypt hash, which records its own cost and salt
+	RegisteredAt time.Time
+}
+
+// NewAccount creates a new Account with the given password. Hashing the
+// password is deliberately slow.
+func NewAccount(name, password string) (*Account, error) {
+	if len(password) > MaxPasswordLength {
+		return nil, ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+	return &Account{
+		Name:         name,
+		PasswordHash: hash,
+		RegisteredAt: time.Now(),
+	}, nil
+}
+
+// CheckPassword checks if the password matches the account's password
+func (a *Account) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(a.PasswordHash, []byte(password)) == nil
+}
+
+// String returns a string representation of the Account
+func (a *Account) String() string {
+	return fmt.Sprintf("Account{Name: %s, RegisteredAt: %s}", a.Name, a.RegisteredAt.Format(time.RFC3339))
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Types of the batches the server opens
+const (
+	BatchChatHistory     = "chathistory"
+	BatchLabeledResponse = "labeled-response"
+	// BatchNames groups the NAMES replies of a channel. It is a vendor type,
+	// whose lines clients that do not know it handle as usual.
+	BatchNames = "gossip/names"
+)
+
+// batchCounter numbers the batches the server opens, so that no two batches
+// share a reference
+var batchCounter atomic.Uint64
+
+// Batch groups lines the IRCv3 batch way: a BATCH +ref line opens it, every
+// line inside carries a batch=ref tag and a BATCH -ref line closes it.
+// Batches nest, a line already carrying a batch tag belongs to a nested
+// batch and is left alone.
+type Batch struct {
+	Source string // the server opening the batch
+	Type   string
+	Params []string
+	items  []batchItem
+}
+
+// batchItem is either a line or a nested batch
+type batchItem struct {
+	line  string
+	batch *Batch
+}
+
+func NewBatch(source, batchType string, params ...string) *Batch {
+	return &Batch{Source: source, Type: batchType, Params: params}
+}
+
+// Add appends lines to the batch
+func (b *Batch) Add(lines ...string) {
+	for _, line := range lines {
+		if line != "" {
+			b.items = append(b.items, batchItem{line: line})
+		}
+	}
+}
+
+// AddBatch nests a batch inside this one
+func (b *Batch) AddBatch(child *Batch) {
+	b.items = append(b.items, batchItem{batch: child})
+}
+
+// Lines renders the batch for a client. A client without the batch
+// capability gets the plain lines of the batch and its nested batches. Each
+// rendering allocates new references.
+func (b *Batch) Lines(enabled bool) []string {
+	var lines []string
+	for _, item := range b.items {
+		if item.batch != nil {
+			lines = append(lines, item.batch.Lines(enabled)...)
+		} else {
+			lines = append(lines, item.line)
+		}
+	}
+	if !enabled || len(lines) == 0 {
+		return lines
+	}
+
+	ref := strconv.FormatUint(batchCounter.Add(1), 36)
+	start := fmt.Sprintf(":%s BATCH +%s %s", b.Source, ref, b.Type)
+	for _, param := range b.Params {
+		start += " " + param
+	}
+	rendered := make([]string, 0, len(lines)+2)
+	rendered = append(rendered, start)
+	for _, line := range lines {
+		if !hasBatchTag(line) {
+			line = AddTag(line, "batch", ref)
+		}
+		rendered = append(rendered, line)
+	}
+	return append(rendered, fmt.Sprintf(":%s BATCH -%s", b.Source, ref))
+}
+
+// hasBatchTag reports whether a line carries a batch tag
+func hasBatchTag(line string) bool {
+	if !strings.HasPrefix(line, "@") {
+		return false
+	}
+	tags, _, _ := strings.Cut(line[1:], " ")
+	for _, tag := range strings.Split(tags, ";") {
+		if key, _, _ := strings.Cut(tag, "="); key == "batch" {
+			return true
+		}
+	}
+	return false
+}
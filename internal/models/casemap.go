@@ -0,0 +1,62 @@
+package models
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Casemapping names, as advertised in the CASEMAPPING RPL_ISUPPORT token
+const (
+	CasemappingASCII         = "ascii"
+	CasemappingRFC1459       = "rfc1459"
+	CasemappingStrictRFC1459 = "strict-rfc1459"
+)
+
+// casemapping is the casemapping used to compare nicknames and channel
+// names. It is set once at startup.
+var casemapping atomic.Value
+
+// SetCasemapping selects the casemapping used by Fold
+func SetCasemapping(name string) error {
+	switch name {
+	case CasemappingASCII, CasemappingRFC1459, CasemappingStrictRFC1459:
+		casemapping.Store(name)
+		return nil
+	}
+	return fmt.Errorf("unknown casemapping %q", name)
+}
+
+// Casemapping returns the name of the casemapping in use
+func Casemapping() string {
+	if name, ok := casemapping.Load().(string); ok {
+		return name
+	}
+	return CasemappingASCII
+}
+
+// Fold returns the canonical form of a nickname or channel name, so that
+// names differing only in case map to the same key. Names keep their
+// original case for display.
+func Fold(name string) string {
+	mapping := Casemapping()
+	folded := []byte(name)
+	for i, c := range folded {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			folded[i] = c + ('a' - 'A')
+		case mapping == CasemappingASCII:
+		// RFC 1459 treats []\ as the upper case of {}|, and ~ as that of ^
+		case c == '[' || c == ']' || c == '\\':
+			folded[i] = c + ('{' - '[')
+		case c == '~' && mapping == CasemappingRFC1459:
+			folded[i] = '^'
+		}
+	}
+	return string(folded)
+}
+
+// NamesEqual reports whether two nicknames or channel names are the same
+// under the casemapping
+func NamesEqual(a, b string) bool {
+	return Fold(a) == Fold(b)
+}
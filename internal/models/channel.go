@@ -9,15 +9,133 @@ import (
 type Channel struct {
 	Name        string
 	Topic       string
+	TopicSetBy  string
+	TopicSetAt  time.Time
+	TopicHistory []TopicEntry // Oldest first, the last entry is the current topic
 	CreatedAt   time.Time
-	Users       map[string]*User
+	Members     map[string]*Member // Key: user ID
 	Modes       ChannelModes
 	UserLimits  int
 	BanList     []string
-	InviteList  []string
+	Invites     map[string]*Invite // Key: invited user ID
 	Key         string
-	Operators   map[string]bool
-	Voices      map[string]bool
+	Registration *ChannelRegistration // nil unless the channel is registered
+}
+
+// ChannelRegistration holds the account-based ownership of a registered
+// channel. Registered channels are kept when they become empty.
+type ChannelRegistration struct {
+	Founder      string // Founder account name
+	RegisteredAt time.Time
+	Access       map[string]ChannelPrivilege // Key: account name folded by Fold
+}
+
+// MaxTopicHistory is the number of topics kept in a channel's topic history
+const MaxTopicHistory = 20
+
+// TopicEntry records a topic and who set it
+type TopicEntry struct {
+	Topic string
+	SetBy string
+	SetAt time.Time
+}
+
+// Invite represents a pending invitation of a user to a channel
+type Invite struct {
+	Nickname  string
+	InvitedBy string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// IsExpired checks if the invitation is no longer valid
+func (i *Invite) IsExpired() bool {
+	return time.Now().After(i.ExpiresAt)
+}
+
+// Member represents a user's membership in a channel
+type Member struct {
+	User       *User
+	JoinedAt   time.Time
+	Privileges map[ChannelPrivilege]bool
+}
+
+// ChannelPrivilege represents a member's rank within a channel
+type ChannelPrivilege int
+
+const (
+	PrivilegeNone ChannelPrivilege = iota
+	PrivilegeVoice
+	PrivilegeHalfOp
+	PrivilegeOp
+	PrivilegeAdmin
+	PrivilegeOwner
+)
+
+// channelPrivileges lists the ranked privileges from highest to lowest
+var channelPrivileges = []ChannelPrivilege{PrivilegeOwner, PrivilegeAdmin, PrivilegeOp, PrivilegeHalfOp, PrivilegeVoice}
+
+// Prefix returns the NAMES/WHO prefix character for the privilege
+func (p ChannelPrivilege) Prefix() string {
+	switch p {
+	case PrivilegeOwner:
+		return "~"
+	case PrivilegeAdmin:
+		return "&"
+	case PrivilegeOp:
+		return "@"
+	case PrivilegeHalfOp:
+		return "%"
+	case PrivilegeVoice:
+		return "+"
+	}
+	return ""
+}
+
+// ModeChar returns the channel mode letter that grants the privilege
+func (p ChannelPrivilege) ModeChar() string {
+	switch p {
+	case PrivilegeOwner:
+		return "q"
+	case PrivilegeAdmin:
+		return "a"
+	case PrivilegeOp:
+		return "o"
+	case PrivilegeHalfOp:
+		return "h"
+	case PrivilegeVoice:
+		return "v"
+	}
+	return ""
+}
+
+// PrivilegeFromMode returns the privilege granted by a channel mode letter
+func PrivilegeFromMode(mode string) (ChannelPrivilege, bool) {
+	for _, p := range channelPrivileges {
+		if p.ModeChar() == mode {
+			return p, true
+		}
+	}
+	return PrivilegeNone, false
+}
+
+// PrefixISupport returns the value of the PREFIX ISUPPORT token, e.g. "(qaohv)~&@%+"
+func PrefixISupport() string {
+	modes := ""
+	for _, p := range channelPrivileges {
+		modes += p.ModeChar()
+	}
+	return "(" + modes + ")" + MembershipPrefixes()
+}
+
+// MembershipPrefixes returns the prefix characters of all privileges, from
+// the highest, e.g. "~&@%+"
+func MembershipPrefixes() string {
+	prefixes := ""
+	for _, p := range channelPrivileges {
+		prefixes += p.Prefix()
+	}
+	return prefixes
 }
 
 // ChannelModes represents the modes a channel can have
@@ -34,31 +152,64 @@ type ChannelModes struct {
 func NewChannel(name string) *Channel {
 	return &Channel{
 		Name:        name,
-		Topic:       fmt.Sprintf("Welcome to %s!", name),
+		TopicHistory: make([]TopicEntry, 0),
 		CreatedAt:   time.Now(),
-		Users:       make(map[string]*User),
+		Members:     make(map[string]*Member),
 		Modes:       ChannelModes{},
 		UserLimits:  0,
 		BanList:     make([]string, 0),
-		InviteList:  make([]string, 0),
-		Operators:   make(map[string]bool),
-		Voices:      make(map[string]bool),
+		Invites:     make(map[string]*Invite),
 	}
 }
 
-// AddUser adds a user to the channel
+// AddUser adds a user to the channel, keeping any existing membership
 func (c *Channel) AddUser(user *User) {
-	c.Users[user.Nickname] = user
+	if _, exists := c.Members[user.ID]; exists {
+		return
+	}
+	c.Members[user.ID] = &Member{
+		User:       user,
+		JoinedAt:   time.Now(),
+		Privileges: make(map[ChannelPrivilege]bool),
+	}
 }
 
 // RemoveUser removes a user from the channel
-func (c *Channel) RemoveUser(nickname string) {
-	delete(c.Users, nickname)
+func (c *Channel) RemoveUser(userID string) {
+	delete(c.Members, userID)
+}
+
+// GetMember returns the membership of a user in the channel
+func (c *Channel) GetMember(userID string) (*Member, bool) {
+	member, exists := c.Members[userID]
+	return member, exists
+}
+
+// HasMember checks if a user is a member of the channel
+func (c *Channel) HasMember(userID string) bool {
+	_, exists := c.Members[userID]
+	return exists
+}
+
+// Users returns the users currently in the channel
+func (c *Channel) Users() []*User {
+	users := make([]*User, 0, len(c.Members))
+	for _, member := range c.Members {
+		users = append(users, member.User)
+	}
+	return users
 }
 
-// SetTopic sets the channel topic
-func (c *Channel) SetTopic(topic string) {
+// SetTopic sets the channel topic and records it in the topic history
+func (c *Channel) SetTopic(topic, setBy string) {
 	c.Topic = topic
+	c.TopicSetBy = setBy
+	c.TopicSetAt = time.Now()
+
+	c.TopicHistory = append(c.TopicHistory, TopicEntry{Topic: topic, SetBy: setBy, SetAt: c.TopicSetAt})
+	if len(c.TopicHistory) > MaxTopicHistory {
+		c.TopicHistory = c.TopicHistory[len(c.TopicHistory)-MaxTopicHistory:]
+	}
 }
 
 // SetMode sets a mode for the channel
@@ -82,6 +233,28 @@ func (c *Channel) SetMode(mode string, value bool) error {
 	return nil
 }
 
+// AddBan adds a mask to the ban list, returning false if it is already there
+func (c *Channel) AddBan(mask string) bool {
+	for _, ban := range c.BanList {
+		if ban == mask {
+			return false
+		}
+	}
+	c.BanList = append(c.BanList, mask)
+	return true
+}
+
+// RemoveBan removes a mask from the ban list, returning false if it was not there
+func (c *Channel) RemoveBan(mask string) bool {
+	for i, ban := range c.BanList {
+		if ban == mask {
+			c.BanList = append(c.BanList[:i], c.BanList[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 // IsBanned checks if a user mask is banned from the channel
 func (c *Channel) IsBanned(userMask string) bool {
 	for _, ban := range c.BanList {
@@ -92,32 +265,224 @@ func (c *Channel) IsBanned(userMask string) bool {
 	return false
 }
 
-// IsInvited checks if a nickname is invited to the channel
-func (c *Channel) IsInvited(nickname string) bool {
-	for _, invite := range c.InviteList {
-		if invite == nickname {
-			return true
+// AddInvite invites a user to the channel until the invitation is used or
+// the ttl elapses
+func (c *Channel) AddInvite(user *User, invitedBy string, ttl time.Duration) {
+	now := time.Now()
+	c.Invites[user.ID] = &Invite{
+		Nickname:  user.Nickname,
+		InvitedBy: invitedBy,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+// IsInvited checks if a user holds a valid invitation to the channel
+func (c *Channel) IsInvited(userID string) bool {
+	invite, exists := c.Invites[userID]
+	if exists && invite.IsExpired() {
+		delete(c.Invites, userID)
+		return false
+	}
+	return exists
+}
+
+// UseInvite consumes a user's invitation, reporting whether it was valid
+func (c *Channel) UseInvite(userID string) bool {
+	invited := c.IsInvited(userID)
+	delete(c.Invites, userID)
+	return invited
+}
+
+// ModeString returns the channel's boolean modes, e.g. "+nt"
+func (c *Channel) ModeString() string {
+	modes := "+"
+	for _, m := range []struct {
+		char string
+		set  bool
+	}{
+		{"i", c.Modes.InviteOnly},
+		{"m", c.Modes.Moderated},
+		{"n", c.Modes.NoExternal},
+		{"p", c.Modes.Private},
+		{"s", c.Modes.Secret},
+		{"t", c.Modes.TopicSettableOnlyByOps},
+	} {
+		if m.set {
+			modes += m.char
 		}
 	}
-	return false
+	return modes
 }
 
 // String returns a string representation of the Channel
 func (c *Channel) String() string {
-	return fmt.Sprintf("Channel{Name: %s, Users: %d, Topic: %s}", c.Name, len(c.Users), c.Topic)
-}
-
-// GetUserList returns a list of usernames in the channel, with @ for operators
-func (c *Channel) GetUserList() []string {
-	userList := make([]string, 0, len(c.Users))
-	for nickname := range c.Users {
-		if c.Operators[nickname] {
-			userList = append(userList, "@"+nickname)
-		} else if c.Voices[nickname] {
-			userList = append(userList, "+"+nickname)
-		} else {
-			userList = append(userList, nickname)
+	return fmt.Sprintf("Channel{Name: %s, Users: %d, Topic: %s}", c.Name, len(c.Members), c.Topic)
+}
+
+// NewChannelRegistration creates a registration owned by the founder account
+func NewChannelRegistration(founder string) *ChannelRegistration {
+	return &ChannelRegistration{
+		Founder:      founder,
+		RegisteredAt: time.Now(),
+		Access:       make(map[string]ChannelPrivilege),
+	}
+}
+
+// AccessLevel returns the privilege an account is entitled to in the channel
+func (r *ChannelRegistration) AccessLevel(account string) ChannelPrivilege {
+	if account == "" {
+		return PrivilegeNone
+	}
+	if NamesEqual(account, r.Founder) {
+		return PrivilegeOwner
+	}
+	return r.Access[Fold(account)]
+}
+
+// ParsePrivilege parses a privilege level name such as "op" or "voice"
+func ParsePrivilege(name string) (ChannelPrivilege, bool) {
+	for _, p := range channelPrivileges {
+		if p.String() == name {
+			return p, true
 		}
 	}
+	return PrivilegeNone, false
+}
+
+// String returns the level name of the privilege
+func (p ChannelPrivilege) String() string {
+	switch p {
+	case PrivilegeOwner:
+		return "owner"
+	case PrivilegeAdmin:
+		return "admin"
+	case PrivilegeOp:
+		return "op"
+	case PrivilegeHalfOp:
+		return "halfop"
+	case PrivilegeVoice:
+		return "voice"
+	}
+	return "none"
+}
+
+// HighestPrivilege returns the highest privilege held by the member
+func (m *Member) HighestPrivilege() ChannelPrivilege {
+	for _, p := range channelPrivileges {
+		if m.Privileges[p] {
+			return p
+		}
+	}
+	return PrivilegeNone
+}
+
+// Prefix returns the prefix characters for the member. With multiPrefix
+// every held privilege is listed, highest first, otherwise only the highest.
+func (m *Member) Prefix(multiPrefix bool) string {
+	if !multiPrefix {
+		return m.HighestPrivilege().Prefix()
+	}
+	prefix := ""
+	for _, p := range channelPrivileges {
+		if m.Privileges[p] {
+			prefix += p.Prefix()
+		}
+	}
+	return prefix
+}
+
+// SetPrivilege grants or revokes a privilege for a member
+func (c *Channel) SetPrivilege(userID string, p ChannelPrivilege, value bool) {
+	member, exists := c.Members[userID]
+	if !exists || p == PrivilegeNone {
+		return
+	}
+	if value {
+		member.Privileges[p] = true
+	} else {
+		delete(member.Privileges, p)
+	}
+}
+
+// HasPrivilege checks if a member holds exactly the given privilege
+func (c *Channel) HasPrivilege(userID string, p ChannelPrivilege) bool {
+	member, exists := c.Members[userID]
+	return exists && member.Privileges[p]
+}
+
+// ClearPrivileges revokes every privilege held by a member
+func (c *Channel) ClearPrivileges(userID string) {
+	if member, exists := c.Members[userID]; exists {
+		member.Privileges = make(map[ChannelPrivilege]bool)
+	}
+}
+
+// HighestPrivilege returns the highest privilege held by a member
+func (c *Channel) HighestPrivilege(userID string) ChannelPrivilege {
+	member, exists := c.Members[userID]
+	if !exists {
+		return PrivilegeNone
+	}
+	return member.HighestPrivilege()
+}
+
+// IsAtLeast checks if a member's highest privilege is at least the given rank
+func (c *Channel) IsAtLeast(userID string, p ChannelPrivilege) bool {
+	return c.HighestPrivilege(userID) >= p
+}
+
+// CanGrant checks if a member may grant or revoke the given privilege
+func (c *Channel) CanGrant(userID string, p ChannelPrivilege) bool {
+	rank := c.HighestPrivilege(userID)
+	switch p {
+	case PrivilegeVoice:
+		return rank >= PrivilegeHalfOp
+	case PrivilegeHalfOp, PrivilegeOp:
+		return rank >= PrivilegeOp
+	default:
+		return rank >= p
+	}
+}
+
+// CanKick checks if a member may kick the target member. Half-operators
+// may only kick members ranked below them, operators and above may also kick
+// their peers.
+func (c *Channel) CanKick(userID, targetID string) bool {
+	rank := c.HighestPrivilege(userID)
+	targetRank := c.HighestPrivilege(targetID)
+	if rank < PrivilegeHalfOp {
+		return false
+	}
+	if rank >= PrivilegeOp {
+		return rank >= targetRank
+	}
+	return rank > targetRank
+}
+
+// GetUserList returns a list of nicknames in the channel with their privilege
+// prefixes, as full nick!user@host masks when userhost is set
+func (c *Channel) GetUserList(multiPrefix, userhost bool) []string {
+	userList := make([]string, 0, len(c.Members))
+	for _, member := range c.Members {
+		name := member.User.Nickname
+		if userhost {
+			name = member.User.Hostmask()
+		}
+		userList = append(userList, member.Prefix(multiPrefix)+name)
+	}
 	return userList
 }
+
+// Symbol returns the channel status used in NAMES replies: @ for secret,
+// * for private and = for public channels
+func (c *Channel) Symbol() string {
+	switch {
+	case c.Modes.Secret:
+		return "@"
+	case c.Modes.Private:
+		return "*"
+	default:
+		return "="
+	}
+}
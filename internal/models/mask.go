@@ -0,0 +1,30 @@
+package models
+
+// MatchMask reports whether s matches the IRC wildcard mask, where '*'
+// matches any sequence of characters and '?' matches exactly one. Case is
+// ignored according to the casemapping.
+func MatchMask(mask, s string) bool {
+	mask, s = Fold(mask), Fold(s)
+	m, i := 0, 0
+	starM, starI := -1, 0
+	for i < len(s) {
+		switch {
+		case m < len(mask) && (mask[m] == '?' || mask[m] == s[i]):
+			m++
+			i++
+		case m < len(mask) && mask[m] == '*':
+			starM, starI = m, i
+			m++
+		case starM >= 0:
+			// Backtrack: let the last '*' swallow one more character
+			starI++
+			m, i = starM+1, starI
+		default:
+			return false
+		}
+	}
+	for m < len(mask) && mask[m] == '*' {
+		m++
+	}
+	return m == len(mask)
+}
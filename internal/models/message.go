@@ -2,9 +2,19 @@ package models
 
 import (
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// MaxLineLength is the maximum length of an IRC line, including the CRLF
+const MaxLineLength = 512
+
+// MaxClientTagsLength is the maximum length of the message tags a client may
+// send, including the leading @ and the trailing space. Tags do not count
+// towards MaxLineLength.
+const MaxClientTagsLength = 4096
+
 // MessageType represents the type of IRC message
 type MessageType int
 
@@ -17,23 +27,25 @@ const (
 
 // Message represents an IRC message
 type Message struct {
-	ID        string
-	Sender    *User
-	Target    string
-	Content   string
-	Timestamp time.Time
-	Type      MessageType
+	ID         string
+	Sender     *User
+	SenderMask string // nick!user@host of the sender when the message was sent
+	Target     string
+	Content    string
+	Timestamp  time.Time
+	Type       MessageType
 }
 
 // NewMessage creates a new Message instance
 func NewMessage(sender *User, target, content string, msgType MessageType) *Message {
 	return &Message{
-		ID:        generateUniqueID(), // TODO: Implement this function
-		Sender:    sender,
-		Target:    target,
-		Content:   content,
-		Timestamp: time.Now(),
-		Type:      msgType,
+		ID:         generateUniqueID(),
+		Sender:     sender,
+		SenderMask: sender.Hostmask(),
+		Target:     target,
+		Content:    content,
+		Timestamp:  time.Now(),
+		Type:       msgType,
 	}
 }
 
@@ -47,6 +59,28 @@ func (m *Message) IsChannelMessage() bool {
 	return m.Type == ChannelMessage
 }
 
+// IsNotice checks if the message is a notice
+func (m *Message) IsNotice() bool {
+	return m.Type == Notice
+}
+
+// Command returns the IRC command used to deliver the message
+func (m *Message) Command() string {
+	if m.Type == Notice {
+		return "NOTICE"
+	}
+	return "PRIVMSG"
+}
+
+// IRCLine returns the message formatted as an IRC line. Server messages
+// already hold a complete line in Content.
+func (m *Message) IRCLine() string {
+	if m.Type == ServerMessage {
+		return m.Content
+	}
+	return fmt.Sprintf(":%s %s %s :%s", m.SenderMask, m.Command(), m.Target, m.Content)
+}
+
 // FormattedTimestamp returns a formatted string of the message timestamp
 func (m *Message) FormattedTimestamp() string {
 	return m.Timestamp.Format(time.RFC3339Nano)
@@ -56,3 +90,51 @@ func (m *Message) FormattedTimestamp() string {
 func (m *Message) String() string {
 	return fmt.Sprintf("Message{ID: %s, Sender: %s, Target: %s, Type: %d, Content: %s}", m.ID, m.Sender.Nickname, m.Target, m.Type, m.Content)
 }
+
+// Split returns the message as one or more messages whose IRC lines fit in
+// MaxLineLength, splitting the content without breaking UTF-8 sequences
+func (m *Message) Split() []*Message {
+	if m.Type == ServerMessage {
+		return []*Message{m}
+	}
+	overhead := len(fmt.Sprintf(":%s %s %s :\r\n", m.SenderMask, m.Command(), m.Target))
+	parts := SplitText(m.Content, MaxLineLength-overhead)
+	if len(parts) == 1 {
+		return []*Message{m}
+	}
+	messages := make([]*Message, len(parts))
+	for i, part := range parts {
+		message := *m
+		if i > 0 {
+			message.ID = generateUniqueID()
+		}
+		message.Content = part
+		messages[i] = &message
+	}
+	return messages
+}
+
+// SplitText splits text into parts of at most maxLength bytes on UTF-8
+// boundaries, preferring to break after a space
+func SplitText(text string, maxLength int) []string {
+	if maxLength < utf8.UTFMax {
+		maxLength = utf8.UTFMax
+	}
+	var parts []string
+	for len(text) > maxLength {
+		cut := maxLength
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			// Not valid UTF-8, cut anywhere
+			cut = maxLength
+		}
+		if space := strings.LastIndexByte(text[:cut], ' '); space >= cut/2 {
+			cut = space + 1
+		}
+		parts = append(parts, text[:cut])
+		text = text[cut:]
+	}
+	return append(parts, text)
+}
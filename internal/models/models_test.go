@@ -1,8 +1,11 @@
 package models
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestNewUser(t *testing.T) {
@@ -130,8 +133,8 @@ func TestNewChannel(t *testing.T) {
 	if channel.CreatedAt.IsZero() {
 		t.Error("Expected non-zero CreatedAt")
 	}
-	if len(channel.Users) != 0 {
-		t.Error("Expected empty Users map")
+	if len(channel.Members) != 0 {
+		t.Error("Expected empty Members map")
 	}
 	if channel.UserLimits != 0 {
 		t.Error("Expected UserLimits to be 0")
@@ -139,8 +142,8 @@ func TestNewChannel(t *testing.T) {
 	if len(channel.BanList) != 0 {
 		t.Error("Expected empty BanList")
 	}
-	if len(channel.InviteList) != 0 {
-		t.Error("Expected empty InviteList")
+	if len(channel.Invites) != 0 {
+		t.Error("Expected empty Invites")
 	}
 }
 
@@ -205,18 +208,28 @@ func TestChannelUserOperations(t *testing.T) {
 
 	// Test AddUser
 	channel.AddUser(user)
-	if _, exists := channel.Users[user.Nickname]; !exists {
+	if _, exists := channel.Members[user.ID]; !exists {
 		t.Errorf("Expected user %s to be in channel", user.Nickname)
 	}
 
+	// Membership and privileges survive a nickname change
+	channel.SetPrivilege(user.ID, PrivilegeOp, true)
+	user.Nickname = "renameduser"
+	if !channel.HasMember(user.ID) || !channel.HasPrivilege(user.ID, PrivilegeOp) {
+		t.Error("Expected membership and privileges to survive a nickname change")
+	}
+	if list := channel.GetUserList(false, false); len(list) != 1 || list[0] != "@renameduser" {
+		t.Errorf("Expected user list [@renameduser], got %v", list)
+	}
+
 	// Test RemoveUser
-	channel.RemoveUser(user.Nickname)
-	if _, exists := channel.Users[user.Nickname]; exists {
+	channel.RemoveUser(user.ID)
+	if _, exists := channel.Members[user.ID]; exists {
 		t.Errorf("Expected user %s to be removed from channel", user.Nickname)
 	}
 
 	// Test removing a user that's not in the channel (should not error)
-	channel.RemoveUser(user.Nickname)
+	channel.RemoveUser(user.ID)
 }
 
 func TestChannelBanOperations(t *testing.T) {
@@ -240,20 +253,27 @@ func TestChannelBanOperations(t *testing.T) {
 
 func TestChannelInviteOperations(t *testing.T) {
 	channel := NewChannel("testchannel")
-	nickname := "testuser"
+	user := NewUser("testuser", "testusername", "Test User", "test.host")
 
 	// Test inviting a user
-	channel.InviteList = append(channel.InviteList, nickname)
+	channel.AddInvite(user, "inviter", time.Hour)
 
-	if !channel.IsInvited(nickname) {
-		t.Errorf("Expected user %s to be invited", nickname)
+	if !channel.IsInvited(user.ID) {
+		t.Errorf("Expected user %s to be invited", user.Nickname)
 	}
 
-	// Test uninviting a user
-	channel.InviteList = []string{}
+	// Test that an invitation can only be used once
+	if !channel.UseInvite(user.ID) {
+		t.Errorf("Expected invitation of user %s to be usable", user.Nickname)
+	}
+	if channel.IsInvited(user.ID) {
+		t.Errorf("Expected invitation of user %s to be consumed", user.Nickname)
+	}
 
-	if channel.IsInvited(nickname) {
-		t.Errorf("Expected user %s to be uninvited", nickname)
+	// Test that expired invitations are not honoured
+	channel.AddInvite(user, "inviter", -time.Second)
+	if channel.IsInvited(user.ID) {
+		t.Errorf("Expected expired invitation of user %s to be rejected", user.Nickname)
 	}
 }
 
@@ -321,3 +341,294 @@ func TestMessageFormattedTimestamp(t *testing.T) {
 		t.Errorf("Parsed timestamp %v does not match original timestamp %v", parsed, message.Timestamp)
 	}
 }
+
+func TestChannelPrivileges(t *testing.T) {
+	channel := NewChannel("testchannel")
+	owner := NewUser("owner", "owner", "Owner", "test.host")
+	op := NewUser("op", "op", "Op", "test.host")
+	halfop := NewUser("halfop", "halfop", "Halfop", "test.host")
+	regular := NewUser("regular", "regular", "Regular", "test.host")
+	for _, u := range []*User{owner, op, halfop, regular} {
+		channel.AddUser(u)
+	}
+
+	channel.SetPrivilege(owner.ID, PrivilegeOwner, true)
+	channel.SetPrivilege(op.ID, PrivilegeOp, true)
+	channel.SetPrivilege(op.ID, PrivilegeVoice, true)
+	channel.SetPrivilege(halfop.ID, PrivilegeHalfOp, true)
+
+	if got := channel.HighestPrivilege(op.ID); got != PrivilegeOp {
+		t.Errorf("HighestPrivilege(op) = %v, want %v", got, PrivilegeOp)
+	}
+	member, _ := channel.GetMember(op.ID)
+	if got := member.Prefix(false); got != "@" {
+		t.Errorf("Prefix(false) = %q, want %q", got, "@")
+	}
+	if got := member.Prefix(true); got != "@+" {
+		t.Errorf("Prefix(true) = %q, want %q", got, "@+")
+	}
+	if got := PrefixISupport(); got != "(qaohv)~&@%+" {
+		t.Errorf("PrefixISupport() = %q, want %q", got, "(qaohv)~&@%+")
+	}
+
+	tests := []struct {
+		name   string
+		result bool
+		want   bool
+	}{
+		{"halfop can voice", channel.CanGrant(halfop.ID, PrivilegeVoice), true},
+		{"halfop cannot halfop", channel.CanGrant(halfop.ID, PrivilegeHalfOp), false},
+		{"op cannot grant admin", channel.CanGrant(op.ID, PrivilegeAdmin), false},
+		{"owner can grant owner", channel.CanGrant(owner.ID, PrivilegeOwner), true},
+		{"halfop cannot kick op", channel.CanKick(halfop.ID, op.ID), false},
+		{"halfop can kick regular", channel.CanKick(halfop.ID, regular.ID), true},
+		{"op can kick op", channel.CanKick(op.ID, op.ID), true},
+		{"op cannot kick owner", channel.CanKick(op.ID, owner.ID), false},
+		{"regular cannot kick", channel.CanKick(regular.ID, halfop.ID), false},
+	}
+	for _, tt := range tests {
+		if tt.result != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.result, tt.want)
+		}
+	}
+
+	channel.ClearPrivileges(op.ID)
+	if got := channel.HighestPrivilege(op.ID); got != PrivilegeNone {
+		t.Errorf("HighestPrivilege after ClearPrivileges = %v, want %v", got, PrivilegeNone)
+	}
+}
+
+func TestAccountPassword(t *testing.T) {
+	account, err := NewAccount("alice", "s3cret")
+	if err != nil {
+		t.Fatalf("NewAccount() returned unexpected error: %v", err)
+	}
+	if !account.CheckPassword("s3cret") {
+		t.Error("Expected correct password to be accepted")
+	}
+	if account.CheckPassword("wrong") {
+		t.Error("Expected wrong password to be rejected")
+	}
+	if !strings.HasPrefix(string(account.PasswordHash), "$2a$") {
+		t.Errorf("Expected a bcrypt hash, got %q", account.PasswordHash)
+	}
+	if _, err := NewAccount("bob", strings.Repeat("x", MaxPasswordLength+1)); err != ErrPasswordTooLong {
+		t.Errorf("NewAccount() with a long password returned %v, want ErrPasswordTooLong", err)
+	}
+}
+
+func TestChannelRegistrationAccessLevel(t *testing.T) {
+	registration := NewChannelRegistration("founder")
+	registration.Access["helper"] = PrivilegeVoice
+
+	tests := []struct {
+		account string
+		want    ChannelPrivilege
+	}{
+		{"founder", PrivilegeOwner},
+		{"helper", PrivilegeVoice},
+		{"stranger", PrivilegeNone},
+		{"", PrivilegeNone},
+	}
+	for _, tt := range tests {
+		if got := registration.AccessLevel(tt.account); got != tt.want {
+			t.Errorf("AccessLevel(%q) = %v, want %v", tt.account, got, tt.want)
+		}
+	}
+
+	if level, ok := ParsePrivilege("halfop"); !ok || level != PrivilegeHalfOp {
+		t.Errorf("ParsePrivilege(halfop) = %v, %v", level, ok)
+	}
+}
+
+func TestChannelTopicHistory(t *testing.T) {
+	channel := NewChannel("testchannel")
+	if channel.Topic != "" {
+		t.Errorf("Expected new channel to have no topic, got %q", channel.Topic)
+	}
+
+	for i := 0; i < MaxTopicHistory+5; i++ {
+		channel.SetTopic(fmt.Sprintf("topic %d", i), "setter")
+	}
+
+	if channel.TopicSetBy != "setter" || channel.TopicSetAt.IsZero() {
+		t.Errorf("Expected topic metadata to be recorded, got %q at %v", channel.TopicSetBy, channel.TopicSetAt)
+	}
+	if len(channel.TopicHistory) != MaxTopicHistory {
+		t.Fatalf("Expected %d topic history entries, got %d", MaxTopicHistory, len(channel.TopicHistory))
+	}
+	if last := channel.TopicHistory[len(channel.TopicHistory)-1]; last.Topic != channel.Topic {
+		t.Errorf("Expected last history entry to be the current topic, got %q", last.Topic)
+	}
+}
+
+func TestMessageIRCLine(t *testing.T) {
+	sender := NewUser("sender", "senderusername", "Sender User", "sender.host")
+
+	tests := []struct {
+		msgType MessageType
+		want    string
+	}{
+		{ChannelMessage, ":sender!senderusername@sender.host PRIVMSG #chan :hello"},
+		{Notice, ":sender!senderusername@sender.host NOTICE #chan :hello"},
+	}
+	for _, tt := range tests {
+		if got := NewMessage(sender, "#chan", "hello", tt.msgType).IRCLine(); got != tt.want {
+			t.Errorf("IRCLine() = %q, want %q", got, tt.want)
+		}
+	}
+
+	// The sender's mask is captured when the message is created
+	msg := NewMessage(sender, "#chan", "hello", Notice)
+	sender.Nickname = "renamed"
+	if !msg.IsNotice() || msg.IRCLine() != tests[1].want {
+		t.Errorf("Expected stored notice to keep the original sender, got %q", msg.IRCLine())
+	}
+}
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask  string
+		s     string
+		match bool
+	}{
+		{"*", "anything", true},
+		{"*!*@test.host", "nick!user@test.host", true},
+		{"nick!*@*.host", "nick!user@test.host", true},
+		{"ni?k", "nick", true},
+		{"ni?k", "nik", false},
+		{"*.host", "test.hosts", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a.b", "aXb", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		if got := MatchMask(tt.mask, tt.s); got != tt.match {
+			t.Errorf("MatchMask(%q, %q) = %v, want %v", tt.mask, tt.s, got, tt.match)
+		}
+	}
+}
+
+func TestUserSetAway(t *testing.T) {
+	user := NewUser("testuser", "testusername", "Test User", "test.host")
+
+	user.SetAway("gone fishing")
+	if !user.Modes.Away || user.AwayMessage != "gone fishing" {
+		t.Errorf("Expected user to be away with message, got %v %q", user.Modes.Away, user.AwayMessage)
+	}
+
+	user.SetAway("")
+	if user.Modes.Away || user.AwayMessage != "" {
+		t.Errorf("Expected user to be back, got %v %q", user.Modes.Away, user.AwayMessage)
+	}
+
+	entry := user.WhowasEntry()
+	if entry.Nickname != user.Nickname || entry.Realname != user.Realname || entry.Time.IsZero() {
+		t.Errorf("Unexpected WHOWAS entry %+v", entry)
+	}
+}
+
+func TestCasemapping(t *testing.T) {
+	defer SetCasemapping(Casemapping())
+
+	tests := []struct {
+		casemapping string
+		a, b        string
+		equal       bool
+	}{
+		{CasemappingASCII, "Alice", "alice", true},
+		{CasemappingASCII, "#Go", "#go", true},
+		{CasemappingASCII, "nick[a]", "nick{a}", false},
+		{CasemappingRFC1459, "nick[a]\\", "NICK{A}|", true},
+		{CasemappingRFC1459, "a~", "A^", true},
+		{CasemappingStrictRFC1459, "nick[a]", "nick{a}", true},
+		{CasemappingStrictRFC1459, "a~", "a^", false},
+	}
+	for _, tt := range tests {
+		if err := SetCasemapping(tt.casemapping); err != nil {
+			t.Fatalf("SetCasemapping(%q) failed: %v", tt.casemapping, err)
+		}
+		if got := NamesEqual(tt.a, tt.b); got != tt.equal {
+			t.Errorf("NamesEqual(%q, %q) with %s = %v, want %v", tt.a, tt.b, tt.casemapping, got, tt.equal)
+		}
+	}
+
+	if !MatchMask("Bob!*@*", "bob!user@host") {
+		t.Errorf("Expected masks to match regardless of case")
+	}
+	if err := SetCasemapping("utf-8"); err == nil {
+		t.Errorf("Expected an unknown casemapping to be rejected")
+	}
+}
+
+func TestMessageSplit(t *testing.T) {
+	user := NewUser("sender", "senderuser", "Sender", "test.host")
+	text := strings.Repeat("é", 300) + " " + strings.Repeat("word ", 100)
+	msg := NewMessage(user, "#channel", text, ChannelMessage)
+
+	parts := msg.Split()
+	if len(parts) < 2 {
+		t.Fatalf("Expected the message to be split, got %d part(s)", len(parts))
+	}
+	joined := ""
+	for _, part := range parts {
+		if len(part.IRCLine())+len("\r\n") > MaxLineLength {
+			t.Errorf("Line of %d bytes exceeds the limit", len(part.IRCLine())+len("\r\n"))
+		}
+		if !utf8.ValidString(part.Content) {
+			t.Errorf("Part %q is not valid UTF-8", part.Content)
+		}
+		joined += part.Content
+	}
+	if joined != text {
+		t.Errorf("Parts do not add up to the original text")
+	}
+	if parts[0].ID == parts[1].ID {
+		t.Errorf("Expected each part to have its own ID")
+	}
+
+	short := NewMessage(user, "#channel", "hello", ChannelMessage)
+	if parts := short.Split(); len(parts) != 1 || parts[0] != short {
+		t.Errorf("Expected a short message to be left alone")
+	}
+}
+
+func TestBatchLines(t *testing.T) {
+	inner := NewBatch("server", BatchChatHistory, "#channel")
+	inner.Add(":a PRIVMSG #channel :one", "@time=x :a PRIVMSG #channel :two")
+	outer := NewBatch("server", BatchLabeledResponse)
+	outer.Add(":server 001 nick :hello")
+	outer.AddBatch(inner)
+
+	lines := outer.Lines(true)
+	if len(lines) != 7 {
+		t.Fatalf("Expected 7 lines, got %q", lines)
+	}
+	outerRef := strings.TrimPrefix(strings.Fields(lines[0])[2], "+")
+	innerRef := strings.TrimPrefix(strings.Fields(lines[2])[3], "+")
+	if lines[0] != ":server BATCH +"+outerRef+" labeled-response" || outerRef == innerRef {
+		t.Errorf("Unexpected batch start %q", lines[0])
+	}
+	expected := []string{
+		"@batch=" + outerRef + " :server 001 nick :hello",
+		"@batch=" + outerRef + " :server BATCH +" + innerRef + " chathistory #channel",
+		"@batch=" + innerRef + " :a PRIVMSG #channel :one",
+		"@batch=" + innerRef + ";time=x :a PRIVMSG #channel :two",
+		"@batch=" + outerRef + " :server BATCH -" + innerRef,
+		":server BATCH -" + outerRef,
+	}
+	for i, line := range expected {
+		if lines[i+1] != line {
+			t.Errorf("Line %d = %q, want %q", i+1, lines[i+1], line)
+		}
+	}
+
+	plain := outer.Lines(false)
+	if len(plain) != 3 || plain[0] != ":server 001 nick :hello" || plain[2] != "@time=x :a PRIVMSG #channel :two" {
+		t.Errorf("Expected the plain lines without the batch capability, got %q", plain)
+	}
+
+	if lines := NewBatch("server", BatchNames).Lines(true); len(lines) != 0 {
+		t.Errorf("Expected an empty batch to render no lines, got %q", lines)
+	}
+}
@@ -0,0 +1,32 @@
+package models
+
+import "strings"
+
+var tagValueEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n")
+
+// EscapeTagValue escapes a message tag value as the IRCv3 message tags
+// specification describes
+func EscapeTagValue(value string) string {
+	return tagValueEscaper.Replace(value)
+}
+
+// AddTag adds a message tag to a line, which may already carry tags
+func AddTag(line, key, value string) string {
+	tag := key
+	if value != "" {
+		tag += "=" + EscapeTagValue(value)
+	}
+	if strings.HasPrefix(line, "@") {
+		return "@" + tag + ";" + line[1:]
+	}
+	return "@" + tag + " " + line
+}
+
+// TagAccount adds the account tag naming the account of the user a line
+// comes from, for sessions that negotiated account-tag
+func TagAccount(line string, sender *User, session ClientSession) string {
+	if sender == nil || sender.Account == "" || session == nil || !session.HasCapability("account-tag") {
+		return line
+	}
+	return AddTag(line, "account", sender.Account)
+}
@@ -9,6 +9,9 @@ import (
 // ClientSession is a forward declaration to avoid circular imports
 type ClientSession interface {
 	SendMessage(message string) error
+	SendBatch(batch *Batch) error
+	HasCapability(name string) bool
+	IsSecure() bool
 }
 
 // User represents an IRC user
@@ -18,6 +21,9 @@ type User struct {
 	Username        string
 	Realname        string
 	Host            string
+	RealHost        string // Host the user connected from, Host may be an account host
+	Account         string // Name of the account the user is logged in to, if any
+	AwayMessage     string
 	CreatedAt       time.Time
 	LastSeen        time.Time
 	LastDisconnect  time.Time
@@ -27,6 +33,16 @@ type User struct {
 	sessionMutex    sync.RWMutex
 }
 
+// WhowasEntry records who used a nickname, for WHOWAS
+type WhowasEntry struct {
+	Nickname string
+	Username string
+	Host     string
+	Realname string
+	Account  string
+	Time     time.Time
+}
+
 // UserModes represents the modes a user can have
 type UserModes struct {
 	Away      bool
@@ -42,6 +58,7 @@ func NewUser(nickname, username, realname, host string) *User {
 		Username:        username,
 		Realname:        realname,
 		Host:            host,
+		RealHost:        host,
 		CreatedAt:       time.Now(),
 		LastSeen:        time.Now(),
 		Channels:        make([]string, 0),
@@ -69,10 +86,87 @@ func (u *User) RemoveClientSession(sessionID string) {
 
 // BroadcastToSessions sends a message to all active sessions of the user
 func (u *User) BroadcastToSessions(message string) {
+	for _, session := range u.Sessions() {
+		session.SendMessage(message)
+	}
+}
+
+// BroadcastToOtherSessions sends a message to all active sessions of the
+// user except one, typically the session whose command caused the message
+// and which gets it as a reply instead
+func (u *User) BroadcastToOtherSessions(message string, except ClientSession) {
+	for _, session := range u.Sessions() {
+		if session != except {
+			session.SendMessage(message)
+		}
+	}
+}
+
+// SendToSessions renders and sends a message individually for each active
+// session of the user, so the output can depend on negotiated capabilities
+func (u *User) SendToSessions(render func(session ClientSession) string) {
+	u.SendToOtherSessions(render, nil)
+}
+
+// SendToOtherSessions is SendToSessions for all sessions but one. Sessions
+// for which render returns "" get nothing.
+func (u *User) SendToOtherSessions(render func(session ClientSession) string, except ClientSession) {
+	for _, session := range u.Sessions() {
+		if session == except {
+			continue
+		}
+		if message := render(session); message != "" {
+			session.SendMessage(message)
+		}
+	}
+}
+
+// Sessions returns a snapshot of the client sessions attached to the user
+func (u *User) Sessions() []ClientSession {
 	u.sessionMutex.RLock()
 	defer u.sessionMutex.RUnlock()
+	sessions := make([]ClientSession, 0, len(u.ClientSessions))
 	for _, session := range u.ClientSessions {
-		session.SendMessage(message)
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// SessionCount returns the number of client sessions attached to the user
+func (u *User) SessionCount() int {
+	u.sessionMutex.RLock()
+	defer u.sessionMutex.RUnlock()
+	return len(u.ClientSessions)
+}
+
+// IsSecure checks if the user is attached and every session uses TLS
+func (u *User) IsSecure() bool {
+	u.sessionMutex.RLock()
+	defer u.sessionMutex.RUnlock()
+	for _, session := range u.ClientSessions {
+		if !session.IsSecure() {
+			return false
+		}
+	}
+	return len(u.ClientSessions) > 0
+}
+
+// SetAway marks the user as away with the given message, or back when the
+// message is empty
+func (u *User) SetAway(message string) {
+	u.AwayMessage = message
+	u.Modes.Away = message != ""
+}
+
+// WhowasEntry returns a snapshot of the user for the WHOWAS history
+func (u *User) WhowasEntry() WhowasEntry {
+	return WhowasEntry{
+		Nickname: u.Nickname,
+		Username: u.Username,
+		Host:     u.Host,
+		Realname: u.Realname,
+		Account:  u.Account,
+		Time:     time.Now(),
 	}
 }
 
@@ -94,7 +188,7 @@ func (u *User) SetMode(mode string, value bool) error {
 // IsInChannel checks if the user is in a specific channel
 func (u *User) IsInChannel(channelName string) bool {
 	for _, ch := range u.Channels {
-		if ch == channelName {
+		if NamesEqual(ch, channelName) {
 			return true
 		}
 	}
@@ -111,13 +205,33 @@ func (u *User) JoinChannel(channelName string) {
 // LeaveChannel removes a channel from the user's list of channels
 func (u *User) LeaveChannel(channelName string) {
 	for i, ch := range u.Channels {
-		if ch == channelName {
+		if NamesEqual(ch, channelName) {
 			u.Channels = append(u.Channels[:i], u.Channels[i+1:]...)
 			break
 		}
 	}
 }
 
+// Hostmask returns the user's nick!user@host mask
+func (u *User) Hostmask() string {
+	return fmt.Sprintf("%s!%s@%s", u.Nickname, u.Username, u.Host)
+}
+
+// JoinLine returns the user's JOIN of a channel as a session sees it: with
+// the account and realname for sessions that negotiated extended-join, and
+// the account tag for those that negotiated account-tag
+func (u *User) JoinLine(channelName string, session ClientSession) string {
+	line := fmt.Sprintf(":%s JOIN %s", u.Hostmask(), channelName)
+	if session != nil && session.HasCapability("extended-join") {
+		account := u.Account
+		if account == "" {
+			account = "*"
+		}
+		line += fmt.Sprintf(" %s :%s", account, u.Realname)
+	}
+	return TagAccount(line, u, session)
+}
+
 // UpdateLastSeen updates the user's last seen timestamp
 func (u *User) UpdateLastSeen() {
 	u.LastSeen = time.Now()
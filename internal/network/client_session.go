@@ -2,11 +2,14 @@ package network
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/exogmi/gossip/config"
 	"github.com/exogmi/gossip/internal/models"
@@ -23,15 +26,39 @@ type ClientSession struct {
 	protocolHandler *protocol.ProtocolHandler
 	reader          *bufio.Reader
 	writer          *bufio.Writer
-	incoming        chan string
+	incoming        chan inboundLine
 	outgoing        chan string
 	stopChan        chan struct{}
 	wg              sync.WaitGroup
 	verbosity       config.VerbosityLevel
 	clientID        string
 	sessionID       string
+	stopOnce        sync.Once
+	writeMu         sync.Mutex
+
+	// closing is set once closeLink queued the final lines, after which no
+	// line is queued anymore. flushChan is then closed for the write loop to
+	// send what is queued and shut the session down.
+	closing   bool
+	closingMu sync.RWMutex
+	flushChan chan struct{}
+
+	registrationTimeout time.Duration
+	utf8Only            bool   // Reject input that is not valid UTF-8
+	legacyEncoding      string // Encoding to decode input that is not valid UTF-8 from, or ""
+	encoding            string // Encoding of the client's input, decided by its first non-ASCII line
+}
+
+// inboundLine is a line read from the client. Lines over the length limits
+// are not passed on, only reported.
+type inboundLine struct {
+	text    string
+	tooLong bool
 }
 
+// defaultRegistrationTimeout applies when the configuration does not set one
+const defaultRegistrationTimeout = time.Minute
+
 // Ensure ClientSession implements the models.ClientSession interface
 var _ models.ClientSession = (*ClientSession)(nil)
 
@@ -41,20 +68,29 @@ func (cs *ClientSession) SetUser(user *models.User) {
 }
 
 func NewClientSession(conn net.Conn, stateManager *state.StateManager, verbosity config.VerbosityLevel) *ClientSession {
-	return &ClientSession{
+	cs := &ClientSession{
 		conn:            conn,
 		stateManager:    stateManager,
 		protocolParser:  protocol.NewProtocolParser(),
 		protocolHandler: protocol.NewProtocolHandler(stateManager),
-		reader:          bufio.NewReader(conn),
+		reader:          bufio.NewReaderSize(conn, models.MaxClientTagsLength+models.MaxLineLength),
 		writer:          bufio.NewWriter(conn),
-		incoming:        make(chan string, 100),
+		incoming:        make(chan inboundLine, 100),
 		outgoing:        make(chan string, 100),
 		stopChan:        make(chan struct{}),
+		flushChan:       make(chan struct{}),
 		verbosity:       verbosity,
 		clientID:        uuid.New().String(),
 		sessionID:       uuid.New().String(),
 	}
+	cs.registrationTimeout = defaultRegistrationTimeout
+	if stateManager.Config != nil {
+		cs.registrationTimeout = stateManager.Config.RegistrationTimeout
+		cs.utf8Only = stateManager.Config.UTF8Only
+		cs.legacyEncoding = stateManager.Config.LegacyEncoding
+	}
+	cs.protocolHandler.SetSession(cs)
+	return cs
 }
 
 func (cs *ClientSession) Start() {
@@ -66,29 +102,39 @@ func (cs *ClientSession) Start() {
 	// Start ping-pong routine
 	go cs.pingPongLoop()
 
+	// Drop clients that do not complete registration in time
+	timer := time.AfterFunc(cs.registrationTimeout, func() {
+		if !cs.protocolHandler.IsRegistered() {
+			log.Printf("Registration timed out for client %s", cs.clientID)
+			cs.closeLink(nil, "Registration timed out")
+		}
+	})
+	defer timer.Stop()
+
 	cs.wg.Wait()
 }
 
 func (cs *ClientSession) Stop() {
-	select {
-	case <-cs.stopChan:
-		// Channel is already closed, do nothing
-	default:
-		close(cs.stopChan)
-	}
-	if cs.user != nil {
-		cs.user.RemoveClientSession(cs.sessionID)
-		if len(cs.user.ClientSessions) == 0 {
-			cs.user.LastDisconnect = time.Now()
-		}
-	}
-	cs.conn.Close()
+	cs.shutdown()
 	cs.wg.Wait()
 	if cs.verbosity >= config.Debug {
 		log.Printf("Client session stopped for %s", cs.clientID)
 	}
 }
 
+// shutdown closes the session without waiting for its loops to exit, so it
+// is safe to call from within those loops.
+func (cs *ClientSession) shutdown() {
+	cs.stopOnce.Do(func() {
+		close(cs.stopChan)
+		if cs.user != nil {
+			cs.user.RemoveClientSession(cs.sessionID)
+			cs.stateManager.Monitor.SessionDetached(cs.user)
+		}
+		cs.conn.Close()
+	})
+}
+
 func (cs *ClientSession) readLoop() {
 	defer cs.wg.Done()
 	for {
@@ -96,20 +142,85 @@ func (cs *ClientSession) readLoop() {
 		case <-cs.stopChan:
 			return
 		default:
-			line, err := cs.reader.ReadString('\n')
+			line, err := cs.readLine()
 			if err != nil {
 				log.Printf("Error reading from client %s: %v", cs.clientID, err)
-				cs.Stop()
+				cs.shutdown()
 				return
 			}
 			if cs.verbosity >= config.Trace {
-				log.Printf("Received from client %s: %s", cs.clientID, line)
+				log.Printf("Received from client %s: %s", cs.clientID, protocol.Redact(line.text))
+			}
+			select {
+			case cs.incoming <- line:
+			case <-cs.stopChan:
+				return
 			}
-			cs.incoming <- line
 		}
 	}
 }
 
+// readLine reads the next line from the client. A line that exceeds the
+// length limits is read to its end and discarded.
+func (cs *ClientSession) readLine() (inboundLine, error) {
+	line, err := cs.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = cs.reader.ReadSlice('\n')
+		}
+		if err != nil {
+			return inboundLine{}, err
+		}
+		return inboundLine{tooLong: true}, nil
+	}
+	if err != nil {
+		return inboundLine{}, err
+	}
+	if !fitsLineLimits(line) {
+		return inboundLine{tooLong: true}, nil
+	}
+	return inboundLine{text: string(line)}, nil
+}
+
+// decodeLine returns a line as UTF-8. When a fallback is configured, the
+// first line of a connection that is not ASCII decides its encoding: UTF-8
+// if it is valid UTF-8, else the legacy encoding all its input is then
+// transcoded from.
+func (cs *ClientSession) decodeLine(line string) string {
+	if cs.legacyEncoding == "" {
+		return line
+	}
+	if cs.encoding == "" {
+		if isASCII(line) {
+			return line
+		}
+		if utf8.ValidString(line) {
+			cs.encoding = EncodingUTF8
+		} else {
+			cs.encoding = cs.legacyEncoding
+			log.Printf("Client %s sent input that is not UTF-8, decoding it as %s", cs.clientID, cs.legacyEncoding)
+		}
+	}
+	if cs.encoding == EncodingUTF8 {
+		return line
+	}
+	return decodeLegacy(line, cs.encoding)
+}
+
+// fitsLineLimits checks a line against MaxLineLength, with the message tags
+// counted separately against MaxClientTagsLength
+func fitsLineLimits(line []byte) bool {
+	if len(line) > 0 && line[0] == '@' {
+		end := bytes.IndexByte(line, ' ')
+		if end < 0 || end+1 > models.MaxClientTagsLength {
+			return false
+		}
+		line = line[end+1:]
+	}
+	// Clients that end lines with a bare LF are held to the same limit
+	return len(bytes.TrimRight(line, "\r\n")) <= models.MaxLineLength-len("\r\n")
+}
+
 func (cs *ClientSession) writeLoop() {
 	defer cs.wg.Done()
 	for {
@@ -117,16 +228,102 @@ func (cs *ClientSession) writeLoop() {
 		case <-cs.stopChan:
 			return
 		case msg := <-cs.outgoing:
-			_, err := cs.writer.WriteString(msg + "\r\n")
-			if err != nil {
+			if err := cs.writeLine(msg); err != nil {
 				log.Printf("Error writing to client %s: %v", cs.clientID, err)
-				cs.Stop()
+				cs.shutdown()
 				return
 			}
-			cs.writer.Flush()
-			if cs.verbosity >= config.Trace {
-				log.Printf("Sent to client %s: %s", cs.clientID, msg)
+		case <-cs.flushChan:
+			cs.flush()
+			cs.shutdown()
+			return
+		}
+	}
+}
+
+// flush writes the lines left in the queue of a closing link
+func (cs *ClientSession) flush() {
+	for {
+		select {
+		case msg := <-cs.outgoing:
+			if err := cs.writeLine(msg); err != nil {
+				log.Printf("Error writing to client %s: %v", cs.clientID, err)
+				return
 			}
+		default:
+			return
+		}
+	}
+}
+
+// writeLine writes a single line to the connection
+func (cs *ClientSession) writeLine(msg string) error {
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+
+	if _, err := cs.writer.WriteString(msg + "\r\n"); err != nil {
+		return err
+	}
+	if err := cs.writer.Flush(); err != nil {
+		return err
+	}
+	if cs.verbosity >= config.Trace {
+		log.Printf("Sent to client %s: %s", cs.clientID, protocol.Redact(msg))
+	}
+	return nil
+}
+
+// closeLink queues the final replies and an ERROR explaining why the link is
+// closed behind the lines already queued, then has the write loop send them
+// and shut the session down
+func (cs *ClientSession) closeLink(replies []string, reason string) {
+	cs.closingMu.Lock()
+	defer cs.closingMu.Unlock()
+	if cs.closing {
+		return
+	}
+	cs.closing = true
+
+	lines := append(replies, fmt.Sprintf("ERROR :Closing Link: %s (%s)", cs.conn.RemoteAddr(), reason))
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		select {
+		case cs.outgoing <- line:
+		case <-cs.stopChan:
+			return
+		}
+	}
+	close(cs.flushChan)
+}
+
+// enqueue hands a line to the write loop, giving up once the session is
+// closed or when timeout fires. A nil timeout waits for room in the queue.
+func (cs *ClientSession) enqueue(line string, timeout <-chan time.Time) error {
+	cs.closingMu.RLock()
+	defer cs.closingMu.RUnlock()
+	if cs.closing {
+		return fmt.Errorf("client session %s is closed", cs.clientID)
+	}
+	select {
+	case cs.outgoing <- line:
+		return nil
+	case <-cs.stopChan:
+		return fmt.Errorf("client session %s is closed", cs.clientID)
+	case <-timeout:
+		return fmt.Errorf("send message timeout for client %s", cs.clientID)
+	}
+}
+
+// sendReplies queues the replies to a command, in order
+func (cs *ClientSession) sendReplies(replies []string) {
+	for _, reply := range replies {
+		if reply == "" {
+			continue
+		}
+		if err := cs.enqueue(reply, nil); err != nil {
+			return
 		}
 	}
 }
@@ -137,12 +334,22 @@ func (cs *ClientSession) handleLoop() {
 		select {
 		case <-cs.stopChan:
 			return
-		case msg := <-cs.incoming:
-			ircMessage, err := cs.protocolParser.Parse(msg)
+		case line := <-cs.incoming:
+			if line.tooLong {
+				log.Printf("Discarded an oversized line from client %s", cs.clientID)
+				cs.sendReplies(cs.protocolHandler.InputTooLong())
+				continue
+			}
+			text := cs.decodeLine(line.text)
+			ircMessage, err := cs.protocolParser.Parse(text)
 			if err != nil {
 				log.Printf("Error parsing message from client %s: %v", cs.clientID, err)
 				continue
 			}
+			if cs.utf8Only && !utf8.ValidString(text) {
+				cs.sendReplies(cs.protocolHandler.InvalidUTF8(ircMessage))
+				continue
+			}
 			if cs.protocolHandler == nil {
 				log.Printf("Error: ProtocolHandler is nil for client %s", cs.clientID)
 				continue
@@ -155,21 +362,16 @@ func (cs *ClientSession) handleLoop() {
 				log.Printf("Error handling command for client %s: %v", cs.clientID, err)
 				continue
 			}
-			for _, response := range responses {
-				if response != "" {
-					cs.outgoing <- response
-				}
+			if reason := cs.protocolHandler.CloseReason(); reason != "" {
+				cs.closeLink(responses, reason)
+				return
 			}
-			if cs.user == nil && (ircMessage.Command == "NICK" || ircMessage.Command == "USER") {
-				user := cs.protocolHandler.GetUser()
-				if user != nil {
+			cs.sendReplies(responses)
+			if cs.user == nil {
+				if user := cs.protocolHandler.GetUser(); user != nil {
 					cs.SetUser(user)
 				}
 			}
-			if ircMessage.Command == "QUIT" {
-				cs.Stop()
-				return
-			}
 		}
 	}
 }
@@ -183,7 +385,9 @@ func (cs *ClientSession) pingPongLoop() {
 		case <-cs.stopChan:
 			return
 		case <-ticker.C:
-			cs.outgoing <- "PING :server"
+			if err := cs.SendMessage("PING :server"); err != nil {
+				return
+			}
 			if cs.verbosity >= config.Trace {
 				log.Printf("Sent PING to client %s", cs.clientID)
 			}
@@ -194,11 +398,33 @@ func (cs *ClientSession) pingPongLoop() {
 
 func (cs *ClientSession) SendMessage(message string) error {
 	select {
-	case cs.outgoing <- message:
-		return nil
-	case <-time.After(5 * time.Second):
-		return fmt.Errorf("send message timeout for client %s", cs.clientID)
+	case <-cs.stopChan:
+		return fmt.Errorf("client session %s is closed", cs.clientID)
+	default:
 	}
+	return cs.enqueue(message, time.After(5*time.Second))
+}
+
+// SendBatch sends a batch of lines, wrapped in BATCH lines if the client
+// negotiated the batch capability
+func (cs *ClientSession) SendBatch(batch *models.Batch) error {
+	for _, line := range batch.Lines(cs.HasCapability("batch")) {
+		if err := cs.SendMessage(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsSecure reports whether the client is connected over TLS
+func (cs *ClientSession) IsSecure() bool {
+	_, ok := cs.conn.(*tls.Conn)
+	return ok
+}
+
+// HasCapability reports whether the client negotiated the given IRCv3 capability
+func (cs *ClientSession) HasCapability(name string) bool {
+	return cs.protocolHandler.HasCapability(name)
 }
 
 func (cs *ClientSession) SendNumericReply(numeric int, params ...string) error {
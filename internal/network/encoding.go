@@ -0,0 +1,54 @@
+package network
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Legacy encodings a connection's input can fall back to when it is not
+// valid UTF-8
+const (
+	EncodingLatin1 = "latin1"
+	EncodingCP1252 = "cp1252"
+)
+
+// EncodingUTF8 is the encoding of connections that sent valid UTF-8
+const EncodingUTF8 = "utf-8"
+
+// isASCII reports whether text holds ASCII only, which reads the same in
+// every supported encoding
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// cp1252High maps the bytes 0x80-0x9F of Windows-1252 to runes. The bytes it
+// leaves undefined keep their Latin-1 meaning, as do all the other bytes.
+var cp1252High = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+// decodeLegacy transcodes text in a legacy single-byte encoding to UTF-8
+func decodeLegacy(s, encoding string) string {
+	var b strings.Builder
+	b.Grow(len(s) * 2)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c < utf8.RuneSelf:
+			b.WriteByte(c)
+		case encoding == EncodingCP1252 && c < 0xA0:
+			b.WriteRune(cp1252High[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
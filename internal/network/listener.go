@@ -100,6 +100,7 @@ func (l *Listener) acceptLoop(listener net.Listener) {
 			}
 
 			atomic.AddInt32(&l.ActiveConns, 1)
+			l.stateManager.ConnectionOpened()
 
 			if l.verbosity >= config.Debug {
 				log.Printf("New connection accepted from %s", conn.RemoteAddr())
@@ -109,6 +110,7 @@ func (l *Listener) acceptLoop(listener net.Listener) {
 			go func() {
 				defer l.wg.Done()
 				defer atomic.AddInt32(&l.ActiveConns, -1)
+				defer l.stateManager.ConnectionClosed()
 				session := NewClientSession(conn, l.stateManager, l.verbosity)
 				session.Start()
 			}()
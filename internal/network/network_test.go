@@ -1,6 +1,7 @@
 package network
 
 import (
+	"bufio"
 	"net"
 	"strings"
 	"sync"
@@ -27,7 +28,7 @@ func TestNewListener(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			listener, err := NewListener(tt.address, stateManager, verbosity)
+			listener, err := NewListener(tt.address, "", stateManager, verbosity, false, "", "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewListener() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -46,7 +47,7 @@ func TestListenerStartStop(t *testing.T) {
 	stateManager := &state.StateManager{}
 	verbosity := config.Info
 
-	listener, err := NewListener("127.0.0.1:0", stateManager, verbosity)
+	listener, err := NewListener("127.0.0.1:0", "", stateManager, verbosity, false, "", "")
 	if err != nil {
 		t.Fatalf("Failed to create listener: %v", err)
 	}
@@ -92,7 +93,7 @@ func TestListenerMaxConnections(t *testing.T) {
 	stateManager := &state.StateManager{}
 	verbosity := config.Info
 
-	listener, err := NewListener("127.0.0.1:0", stateManager, verbosity)
+	listener, err := NewListener("127.0.0.1:0", "", stateManager, verbosity, false, "", "")
 	if err != nil {
 		t.Fatalf("Failed to create listener: %v", err)
 	}
@@ -272,3 +273,131 @@ func TestClientSessionClosure(t *testing.T) {
 		t.Error("SendMessage() should have failed after connection closure")
 	}
 }
+
+func TestFitsLineLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		fits bool
+	}{
+		{"short line", "PRIVMSG #chan :hello\r\n", true},
+		{"512 bytes with CRLF", "PRIVMSG #chan :" + strings.Repeat("a", 512-len("PRIVMSG #chan :\r\n")) + "\r\n", true},
+		{"513 bytes with CRLF", "PRIVMSG #chan :" + strings.Repeat("a", 513-len("PRIVMSG #chan :\r\n")) + "\r\n", false},
+		{"bare LF", "PRIVMSG #chan :" + strings.Repeat("a", 512-len("PRIVMSG #chan :\r\n")) + "\n", true},
+		{"tags do not count", "@" + strings.Repeat("t", 1000) + " PRIVMSG #chan :hello\r\n", true},
+		{"tags over budget", "@" + strings.Repeat("t", 4096) + " PRIVMSG #chan :hello\r\n", false},
+		{"tags without message", "@" + strings.Repeat("t", 10) + "\r\n", false},
+	}
+	for _, tt := range tests {
+		if got := fitsLineLimits([]byte(tt.line)); got != tt.fits {
+			t.Errorf("%s: fitsLineLimits = %v, want %v", tt.name, got, tt.fits)
+		}
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	tests := []struct {
+		input    string
+		encoding string
+		want     string
+	}{
+		{"caf\xe9", EncodingLatin1, "café"},
+		{"caf\xe9", EncodingCP1252, "café"},
+		{"\x80 \x93quoted\x94", EncodingCP1252, "€ “quoted”"},
+		{"\x80", EncodingLatin1, "\u0080"},
+		{"\x81", EncodingCP1252, "\u0081"},
+		{"plain ascii", EncodingCP1252, "plain ascii"},
+	}
+	for _, tt := range tests {
+		if got := decodeLegacy(tt.input, tt.encoding); got != tt.want {
+			t.Errorf("decodeLegacy(%q, %s) = %q, want %q", tt.input, tt.encoding, got, tt.want)
+		}
+	}
+}
+
+func TestClientSessionBadPassword(t *testing.T) {
+	client, server := net.Pipe()
+	cfg := &config.Config{ServerName: "irc.test", NickPolicy: "rfc2812", NickLength: 30, Password: "secret", RegistrationTimeout: time.Minute}
+	stateManager := state.NewStateManager(state.NewUserManager(), state.NewMessageStore(10), cfg)
+
+	session := NewClientSession(server, stateManager, config.Info)
+	done := make(chan struct{})
+	go func() {
+		session.Start()
+		close(done)
+	}()
+	go client.Write([]byte("PASS wrong\r\nNICK alice\r\nUSER alice 0 * :alice\r\n"))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lines []string
+	scanner := bufio.NewScanner(client)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], ":irc.test 464 ") || !strings.HasPrefix(lines[1], "ERROR :Closing Link: ") {
+		t.Errorf("Registration with a wrong password got %q, want 464 then ERROR", lines)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for the session to close")
+	}
+}
+
+func TestClientSessionCloseLink(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	session := NewClientSession(server, &state.StateManager{}, config.Info)
+
+	// Lines queued before the link closes go out before the ERROR, lines
+	// sent after it are refused
+	if err := session.SendMessage("first"); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	session.closeLink([]string{"second", ""}, "Bye")
+	if err := session.SendMessage("third"); err == nil {
+		t.Error("SendMessage() after closeLink should have failed")
+	}
+
+	session.wg.Add(1)
+	go session.writeLoop()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var lines []string
+	scanner := bufio.NewScanner(client)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	if len(lines) != 3 || lines[0] != "first" || lines[1] != "second" || !strings.HasPrefix(lines[2], "ERROR :Closing Link: ") {
+		t.Errorf("Closing the link sent %q, want first, second then ERROR", lines)
+	}
+	session.wg.Wait()
+}
+
+func TestDecodeLinePerConnection(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{"legacy client", []string{"PING ascii", "PRIVMSG #chan :caf\xe9", "PRIVMSG #chan :caf\xc3\xa9"},
+			[]string{"PING ascii", "PRIVMSG #chan :café", "PRIVMSG #chan :cafÃ©"}},
+		{"UTF-8 client", []string{"PRIVMSG #chan :café", "PRIVMSG #chan :caf\xe9"},
+			[]string{"PRIVMSG #chan :café", "PRIVMSG #chan :caf\xe9"}},
+	}
+	for _, tt := range tests {
+		session := &ClientSession{legacyEncoding: EncodingLatin1}
+		for i, line := range tt.lines {
+			if got := session.decodeLine(line); got != tt.want[i] {
+				t.Errorf("%s: decodeLine(%q) = %q, want %q", tt.name, line, got, tt.want[i])
+			}
+		}
+	}
+
+	// Without a fallback lines are left alone
+	session := &ClientSession{}
+	if got := session.decodeLine("caf\xe9"); got != "caf\xe9" {
+		t.Errorf("decodeLine without a fallback = %q", got)
+	}
+}
@@ -0,0 +1,214 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProtocolError is a command failure reported to the client as a numeric
+// error reply
+type ProtocolError struct {
+	Numeric int
+	Params  []string // Parameters between the client's nickname and the message
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%03d %s", e.Numeric, strings.TrimSpace(strings.Join(e.Params, " ")+" "+e.Message))
+}
+
+// Reply renders the error as a numeric reply addressed to a client
+func (e *ProtocolError) Reply(serverName, nickname string) string {
+	params := append([]string{nickname}, e.Params...)
+	return fmt.Sprintf(":%s %03d %s :%s", serverName, e.Numeric, strings.Join(params, " "), e.Message)
+}
+
+func errNoSuchNick(nickname string) *ProtocolError {
+	return &ProtocolError{Numeric: 401, Params: []string{nickname}, Message: "No such nick/channel"}
+}
+
+func errWasNoSuchNick(nickname string) *ProtocolError {
+	return &ProtocolError{Numeric: 406, Params: []string{nickname}, Message: "There was no such nickname"}
+}
+
+func errNoSuchServer(server string) *ProtocolError {
+	return &ProtocolError{Numeric: 402, Params: []string{server}, Message: "No such server"}
+}
+
+func errNoSuchChannel(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 403, Params: []string{channel}, Message: "No such channel"}
+}
+
+func errCannotSendToChan(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 404, Params: []string{channel}, Message: "Cannot send to channel"}
+}
+
+func errTooManyChannels(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 405, Params: []string{channel}, Message: "You have joined too many channels"}
+}
+
+func errTooManyTargets(target string) *ProtocolError {
+	return &ProtocolError{Numeric: 407, Params: []string{target}, Message: "Too many recipients"}
+}
+
+func errInvalidCapCmd(subCommand string) *ProtocolError {
+	return &ProtocolError{Numeric: 410, Params: []string{subCommand}, Message: "Invalid CAP command"}
+}
+
+func errNoRecipient(command string) *ProtocolError {
+	return &ProtocolError{Numeric: 411, Message: fmt.Sprintf("No recipient given (%s)", command)}
+}
+
+func errNoTextToSend() *ProtocolError {
+	return &ProtocolError{Numeric: 412, Message: "No text to send"}
+}
+
+func errInputTooLong() *ProtocolError {
+	return &ProtocolError{Numeric: 417, Message: "Input line was too long"}
+}
+
+func errNoMotd() *ProtocolError {
+	return &ProtocolError{Numeric: 422, Message: "MOTD File is missing"}
+}
+
+func errNoAdminInfo(server string) *ProtocolError {
+	return &ProtocolError{Numeric: 423, Params: []string{server}, Message: "No administrative info available"}
+}
+
+func errUnknownCommand(command string) *ProtocolError {
+	return &ProtocolError{Numeric: 421, Params: []string{command}, Message: "Unknown command"}
+}
+
+func errNoNicknameGiven() *ProtocolError {
+	return &ProtocolError{Numeric: 431, Message: "No nickname given"}
+}
+
+func errNicknameInUse(nickname string) *ProtocolError {
+	return &ProtocolError{Numeric: 433, Params: []string{nickname}, Message: "Nickname is already in use"}
+}
+
+func errErroneusNickname(nickname, reason string) *ProtocolError {
+	return &ProtocolError{Numeric: 432, Params: []string{nickname}, Message: reason}
+}
+
+func errUserNotInChannel(nickname, channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 441, Params: []string{nickname, channel}, Message: "They aren't on that channel"}
+}
+
+func errNotOnChannel(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 442, Params: []string{channel}, Message: "You're not on that channel"}
+}
+
+func errUserOnChannel(nickname, channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 443, Params: []string{nickname, channel}, Message: "is already on channel"}
+}
+
+func errNotRegistered() *ProtocolError {
+	return &ProtocolError{Numeric: 451, Message: "You have not registered"}
+}
+
+func errNeedMoreParams(command string) *ProtocolError {
+	return &ProtocolError{Numeric: 461, Params: []string{command}, Message: "Not enough parameters"}
+}
+
+func errAlreadyRegistered() *ProtocolError {
+	return &ProtocolError{Numeric: 462, Message: "You may not reregister"}
+}
+
+func errPasswdMismatch() *ProtocolError {
+	return &ProtocolError{Numeric: 464, Message: "Password incorrect"}
+}
+
+func errUnknownMode(mode string) *ProtocolError {
+	return &ProtocolError{Numeric: 472, Params: []string{mode}, Message: "is unknown mode char to me"}
+}
+
+func errInviteOnlyChan(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 473, Params: []string{channel}, Message: "Cannot join channel (+i) - you must be invited"}
+}
+
+func errBannedFromChan(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 474, Params: []string{channel}, Message: "Cannot join channel (+b) - you are banned"}
+}
+
+func errBadChannelKey(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 475, Params: []string{channel}, Message: "Cannot join channel (+k) - bad key"}
+}
+
+func errBadChanName(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 479, Params: []string{channel}, Message: "Illegal channel name"}
+}
+
+func errChanOPrivsNeeded(channel string) *ProtocolError {
+	return &ProtocolError{Numeric: 482, Params: []string{channel}, Message: "You're not channel operator"}
+}
+
+// errChanRankTooLow is ERR_CHANOPRIVSNEEDED for members whose rank is too
+// low for the target of a command
+func errChanRankTooLow(channel, reason string) *ProtocolError {
+	return &ProtocolError{Numeric: 482, Params: []string{channel}, Message: reason}
+}
+
+func errUModeUnknownFlag() *ProtocolError {
+	return &ProtocolError{Numeric: 501, Message: "Unknown MODE flag"}
+}
+
+func errUsersDontMatch() *ProtocolError {
+	return &ProtocolError{Numeric: 502, Message: "Cant change mode for other users"}
+}
+
+// StandardReply is an IRCv3 standard reply (FAIL, WARN or NOTE), used by
+// commands that have no suitable numerics. A FAIL is returned as an error.
+type StandardReply struct {
+	Type        string // FAIL, WARN or NOTE
+	Command     string
+	Code        string
+	Context     []string
+	Description string
+}
+
+func (r *StandardReply) Error() string {
+	return fmt.Sprintf("%s %s %s: %s", r.Type, r.Command, r.Code, r.Description)
+}
+
+// Reply renders the standard reply as sent by the server
+func (r *StandardReply) Reply(serverName string) string {
+	params := append([]string{r.Type, r.Command, r.Code}, r.Context...)
+	return fmt.Sprintf(":%s %s :%s", serverName, strings.Join(params, " "), r.Description)
+}
+
+func fail(command, code, description string, context ...string) *StandardReply {
+	return &StandardReply{Type: "FAIL", Command: command, Code: code, Context: context, Description: description}
+}
+
+// reportError turns a protocol error returned by a handler into a reply for
+// the client. Other errors are internal and returned to the caller.
+func (ph *ProtocolHandler) reportError(replies []string, err error) ([]string, error) {
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) {
+		return append(replies, protocolErr.Reply(ph.stateManager.ServerName, ph.clientName())), nil
+	}
+	var standardReply *StandardReply
+	if errors.As(err, &standardReply) {
+		return append(replies, standardReply.Reply(ph.stateManager.ServerName)), nil
+	}
+	return replies, err
+}
+
+// InputTooLong returns the reply to a line that exceeded the length limits
+// and was discarded
+func (ph *ProtocolHandler) InputTooLong() []string {
+	replies, _ := ph.reportError(nil, errInputTooLong())
+	return replies
+}
+
+// InvalidUTF8 returns the reply to a line rejected because it is not valid
+// UTF-8
+func (ph *ProtocolHandler) InvalidUTF8(message *IRCMessage) []string {
+	replies, _ := ph.reportError(nil, fail(message.Command, "INVALID_UTF8", "Message rejected, your IRC software must use UTF-8 encoding on this network"))
+	if label := ph.labelOf(message); label != "" {
+		replies = ph.labelReplies(label, replies)
+	}
+	return replies
+}
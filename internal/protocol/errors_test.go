@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProtocolErrorReply(t *testing.T) {
+	tests := []struct {
+		err  *ProtocolError
+		want string
+	}{
+		{errNoSuchNick("bob"), ":irc.test 401 alice bob :No such nick/channel"},
+		{errNoTextToSend(), ":irc.test 412 alice :No text to send"},
+		{errUserNotInChannel("bob", "#chan"), ":irc.test 441 alice bob #chan :They aren't on that channel"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Reply("irc.test", "alice"); got != tt.want {
+			t.Errorf("Reply() = %q, want %q", got, tt.want)
+		}
+	}
+	if got := fail("SETNAME", "INVALID_REALNAME", "Realname is not valid").Reply("irc.test"); got != ":irc.test FAIL SETNAME INVALID_REALNAME :Realname is not valid" {
+		t.Errorf("StandardReply.Reply() = %q", got)
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+
+	// Errors sent before registration address the client as *
+	if lines := alice.send("NICK"); len(lines) != 1 || lines[0] != ":irc.test 431 * :No nickname given" {
+		t.Errorf("NICK without a nickname got %q, want 431", lines)
+	}
+	alice.register("alice")
+	alice.send("JOIN #chan")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("JOIN #chan")
+	carol := newTestClient(t, stateManager)
+	carol.register("carol")
+	alice.session.take()
+
+	tests := []struct {
+		client  *testClient
+		line    string
+		numeric string
+	}{
+		{bob, "NICK alice", "433"},
+		{bob, "NICK 1bob", "432"},
+		{bob, "PRIVMSG", "411"},
+		{bob, "PRIVMSG alice", "412"},
+		{bob, "PRIVMSG nobody :hi", "401"},
+		{bob, "JOIN", "461"},
+		{bob, "JOIN chan", "403"},
+		{bob, "PART #other", "403"},
+		{bob, "TOPIC #missing", "403"},
+		{bob, "KICK #chan alice", "482"},
+		{alice, "KICK #chan carol", "441"},
+		{alice, "MODE #chan +o carol", "441"},
+		{alice, "MODE #chan +x", "472"},
+		{alice, "MODE alice +z", "501"},
+		{alice, "MODE bob +i", "502"},
+		{alice, "USER alice 0 * :again", "462"},
+		{alice, "FROB", "421"},
+		{alice, "TOPICHISTORY #chan RESTORE 9", "FAIL"},
+	}
+	for _, tt := range tests {
+		lines := tt.client.send(tt.line)
+		if !hasReply(lines, tt.numeric) {
+			t.Errorf("%s got %q, want %s", tt.line, lines, tt.numeric)
+		}
+	}
+
+	alice.send("PART #chan")
+	if lines := alice.send("PART #chan"); !strings.HasPrefix(findReply(lines, "442"), ":irc.test 442 alice #chan :") {
+		t.Errorf("PART of a channel the user left got %q, want 442", lines)
+	}
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+// labelOf returns the label of a command, if the client negotiated
+// labeled-response
+func (ph *ProtocolHandler) labelOf(message *IRCMessage) string {
+	if !ph.HasCapability("labeled-response") {
+		return ""
+	}
+	return message.Tags["label"]
+}
+
+// labelReplies ties the replies to a command sent with a label tag to it, as
+// the labeled-response capability describes: no reply becomes an ACK, a
+// single reply carries the label and several replies are wrapped in a
+// labeled-response batch. Without the batch capability only the first of
+// several replies carries the label.
+func (ph *ProtocolHandler) labelReplies(label string, replies []string) []string {
+	var lines []string
+	for _, reply := range replies {
+		if reply != "" {
+			lines = append(lines, reply)
+		}
+	}
+
+	serverName := ph.stateManager.ServerName
+	switch {
+	case len(lines) == 0:
+		return []string{models.AddTag(fmt.Sprintf(":%s ACK", serverName), "label", label)}
+	case len(lines) == 1 || !ph.HasCapability("batch"):
+		lines[0] = models.AddTag(lines[0], "label", label)
+		return lines
+	}
+
+	batch := models.NewBatch(serverName, models.BatchLabeledResponse)
+	batch.Add(lines...)
+	lines = batch.Lines(true)
+	lines[0] = models.AddTag(lines[0], "label", label)
+	return lines
+}
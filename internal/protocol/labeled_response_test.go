@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabeledResponse(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	client := newTestClient(t, stateManager)
+	client.send("CAP REQ :labeled-response batch echo-message")
+	client.register("alice")
+	client.send("CAP END")
+	client.send("JOIN #chan")
+
+	// No reply is acknowledged with an ACK
+	if lines := client.send("@label=a PONG :token"); len(lines) != 1 || lines[0] != "@label=a :irc.test ACK" {
+		t.Errorf("Labeled PONG got %q, want a labeled ACK", lines)
+	}
+	// A single reply carries the label
+	if lines := client.send("@label=b PING :token"); len(lines) != 1 || !strings.HasPrefix(lines[0], "@label=b :irc.test PONG ") {
+		t.Errorf("Labeled PING got %q, want a labeled PONG", lines)
+	}
+	// So does an error
+	if lines := client.send("@label=c JOIN"); len(lines) != 1 || !strings.HasPrefix(lines[0], "@label=c :irc.test 461 ") {
+		t.Errorf("Labeled JOIN without a channel got %q, want a labeled 461", lines)
+	}
+	// Several replies are wrapped in a labeled-response batch
+	lines := client.send("@label=d LUSERS")
+	if len(lines) < 3 || !strings.HasPrefix(lines[0], "@label=d :irc.test BATCH +") || !strings.HasSuffix(lines[0], " labeled-response") {
+		t.Fatalf("Labeled LUSERS got %q, want a labeled-response batch", lines)
+	}
+	ref := strings.TrimPrefix(strings.Fields(lines[0])[3], "+")
+	for _, line := range lines[1 : len(lines)-1] {
+		if !strings.HasPrefix(line, "@batch="+ref+" ") {
+			t.Errorf("Line %q of the batch lacks its batch tag", line)
+		}
+	}
+	if last := lines[len(lines)-1]; last != ":irc.test BATCH -"+ref {
+		t.Errorf("Batch ends with %q", last)
+	}
+	// The echo of a message is the labeled response
+	if lines := client.send("@label=e PRIVMSG #chan :hello"); len(lines) != 1 || !strings.HasPrefix(lines[0], "@label=e :alice!") {
+		t.Errorf("Labeled PRIVMSG got %q, want a labeled echo", lines)
+	}
+
+	// Without batch only the first of several replies carries the label
+	client = newTestClient(t, stateManager)
+	client.send("CAP REQ :labeled-response")
+	client.register("bob")
+	client.send("CAP END")
+	lines = client.send("@label=f LUSERS")
+	if len(lines) < 2 || !strings.HasPrefix(lines[0], "@label=f :irc.test ") || strings.Contains(strings.Join(lines[1:], "\n"), "label=") {
+		t.Errorf("Labeled LUSERS without batch got %q, want the label on the first line", lines)
+	}
+	if hasReply(lines, "BATCH") {
+		t.Errorf("Labeled LUSERS without batch got a batch: %q", lines)
+	}
+
+	// Labels are ignored from clients that did not negotiate labeled-response
+	client = newTestClient(t, stateManager)
+	client.register("carol")
+	if lines := client.send("@label=g PING :token"); len(lines) != 1 || strings.HasPrefix(lines[0], "@") {
+		t.Errorf("PING from a client without labeled-response got %q", lines)
+	}
+}
@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+// monitorListLength bounds the targets listed in a single MONITOR reply
+const monitorListLength = 400
+
+func (ph *ProtocolHandler) handleMonitorCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 1 || params[0] == "" {
+		return nil, errNeedMoreParams("MONITOR")
+	}
+
+	monitor := ph.stateManager.Monitor
+	switch subCommand := params[0]; subCommand {
+	case "+", "-":
+		if len(params) < 2 {
+			return nil, errNeedMoreParams("MONITOR")
+		}
+		targets := strings.Split(params[1], ",")
+		if subCommand == "-" {
+			for _, target := range targets {
+				monitor.Remove(user, target)
+			}
+			return nil, nil
+		}
+
+		limit := ph.stateManager.Config.MonitorLimit
+		for i, target := range targets {
+			if target == "" {
+				continue
+			}
+			if !monitor.Add(user, target, limit) {
+				replies := ph.monitorStatus(user, targets[:i])
+				return append(replies, fmt.Sprintf(":%s 734 %s %d %s :Monitor list is full.",
+					ph.stateManager.ServerName, user.Nickname, limit, strings.Join(targets[i:], ","))), nil
+			}
+		}
+		return ph.monitorStatus(user, targets), nil
+	case "C", "c":
+		monitor.Clear(user)
+		return nil, nil
+	case "L", "l":
+		targets := monitor.List(user)
+		sort.Strings(targets)
+		replies := ph.monitorReplies(user, "732", targets)
+		return append(replies, fmt.Sprintf(":%s 733 %s :End of MONITOR list", ph.stateManager.ServerName, user.Nickname)), nil
+	case "S", "s":
+		targets := monitor.List(user)
+		sort.Strings(targets)
+		return ph.monitorStatus(user, targets), nil
+	default:
+		return []string{fmt.Sprintf(":%s NOTICE %s :Syntax: MONITOR +|- <nick>[,<nick>...] | C | L | S", ph.stateManager.ServerName, user.Nickname)}, nil
+	}
+}
+
+// monitorStatus returns RPL_MONONLINE and RPL_MONOFFLINE for the targets
+func (ph *ProtocolHandler) monitorStatus(user *models.User, targets []string) []string {
+	var online, offline []string
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		if u, err := ph.stateManager.GetUser(target); err == nil && ph.stateManager.Monitor.IsOnline(u) {
+			online = append(online, u.Hostmask())
+		} else {
+			offline = append(offline, target)
+		}
+	}
+	return append(ph.monitorReplies(user, "730", online), ph.monitorReplies(user, "731", offline)...)
+}
+
+// monitorReplies spreads a comma-separated target list over as many replies
+// as needed to keep each line short
+func (ph *ProtocolHandler) monitorReplies(user *models.User, numeric string, targets []string) []string {
+	var replies []string
+	for len(targets) > 0 {
+		n, length := 0, 0
+		for n < len(targets) && (n == 0 || length+1+len(targets[n]) <= monitorListLength) {
+			length += 1 + len(targets[n])
+			n++
+		}
+		replies = append(replies, fmt.Sprintf(":%s %s %s :%s", ph.stateManager.ServerName, numeric, user.Nickname, strings.Join(targets[:n], ",")))
+		targets = targets[n:]
+	}
+	return replies
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/exogmi/gossip/config"
+)
+
+func TestMonitor(t *testing.T) {
+	stateManager := newTestState(t, func(cfg *config.Config) { cfg.MonitorLimit = 2 })
+	watcher := newTestClient(t, stateManager)
+	watcher.register("alice")
+
+	lines := watcher.send("MONITOR + carol,dave,erin")
+	if got, want := findReply(lines, "731"), ":irc.test 731 alice :carol,dave"; got != want {
+		t.Errorf("MONITOR + offline targets got %q, want %q", got, want)
+	}
+	if got, want := findReply(lines, "734"), ":irc.test 734 alice 2 erin :Monitor list is full."; got != want {
+		t.Errorf("MONITOR + over the limit got %q, want %q", got, want)
+	}
+	lines = watcher.send("MONITOR L")
+	if got, want := findReply(lines, "732"), ":irc.test 732 alice :carol,dave"; got != want || !hasReply(lines, "733") {
+		t.Errorf("MONITOR L got %q, want %q and 733", lines, want)
+	}
+
+	// The watcher learns when a monitored nickname comes and goes
+	carol := newTestClient(t, stateManager)
+	carol.register("carol")
+	if got, want := findReply(watcher.session.take(), "730"), ":irc.test 730 alice :carol!carol@localhost"; got != want {
+		t.Errorf("Monitored user connecting sent %q, want %q", got, want)
+	}
+	carol.send("NICK dave")
+	lines = watcher.session.take()
+	if got, want := findReply(lines, "731"), ":irc.test 731 alice :carol"; got != want {
+		t.Errorf("Monitored user changing nickname sent %q, want %q", got, want)
+	}
+	if got, want := findReply(lines, "730"), ":irc.test 730 alice :dave!carol@localhost"; got != want {
+		t.Errorf("Monitored nickname taken sent %q, want %q", got, want)
+	}
+
+	// Removing targets makes room for others
+	watcher.send("MONITOR - carol")
+	if lines := watcher.send("MONITOR + erin"); hasReply(lines, "734") {
+		t.Errorf("MONITOR + after removing a target got %q", lines)
+	}
+	watcher.send("MONITOR C")
+	if lines := watcher.send("MONITOR L"); hasReply(lines, "732") {
+		t.Errorf("MONITOR L after MONITOR C got %q", lines)
+	}
+	carol.send("NICK carol")
+	if lines := watcher.session.take(); len(lines) != 0 {
+		t.Errorf("Cleared monitor list still notified %q", lines)
+	}
+}
@@ -2,11 +2,16 @@ package protocol
 
 import (
 	"fmt"
-	"regexp"
+	"sort"
 	"strings"
+
+	"github.com/exogmi/gossip/internal/models"
 )
 
+// IRCMessage is a parsed IRC line: optional IRCv3 tags, an optional prefix
+// naming the source, the command and its parameters
 type IRCMessage struct {
+	Tags    map[string]string // nil when the line carries no tags
 	Prefix  string
 	Command string
 	Params  []string
@@ -18,48 +23,169 @@ func NewProtocolParser() *ProtocolParser {
 	return &ProtocolParser{}
 }
 
+// Parse parses a line as described by the modern IRC client protocol and the
+// IRCv3 message tags specification. The line ending, CRLF or a bare LF, is
+// optional. Parameters are separated by one or more spaces and a parameter
+// starting with ':' takes the rest of the line.
 func (p *ProtocolParser) Parse(raw string) (*IRCMessage, error) {
-	// Regex for matching the prefix (if present)
-	prefixRegex := regexp.MustCompile(`^:([^ ]+) `)
-	
-	// Check for prefix
-	var prefix string
-	if strings.HasPrefix(raw, ":") {
-		matches := prefixRegex.FindStringSubmatch(raw)
-		if matches != nil {
-			prefix = matches[1]
-			raw = raw[len(matches[0]):]
+	line := strings.TrimRight(raw, "\r\n")
+	if strings.ContainsAny(line, "\r\n\x00") {
+		return nil, fmt.Errorf("invalid message format: CR, LF or NUL inside the line")
+	}
+	msg := &IRCMessage{}
+
+	if strings.HasPrefix(line, "@") {
+		var tags string
+		tags, line = cutSpace(line[1:])
+		msg.Tags = parseTags(tags)
+	}
+
+	if strings.HasPrefix(line, ":") {
+		msg.Prefix, line = cutSpace(line[1:])
+		if msg.Prefix == "" {
+			return nil, fmt.Errorf("invalid message format: empty prefix")
+		}
+	}
+
+	var command string
+	command, line = cutSpace(line)
+	if !isValidCommand(command) {
+		return nil, fmt.Errorf("invalid message format: bad command %q", command)
+	}
+	msg.Command = upperASCII(command)
+
+	for line != "" {
+		if line[0] == ':' {
+			msg.Params = append(msg.Params, line[1:])
+			break
+		}
+		var param string
+		param, line = cutSpace(line)
+		msg.Params = append(msg.Params, param)
+	}
+
+	return msg, nil
+}
+
+// cutSpace splits s at the first space, dropping the spaces that follow
+func cutSpace(s string) (token, rest string) {
+	token, rest, _ = strings.Cut(s, " ")
+	return token, strings.TrimLeft(rest, " ")
+}
+
+// isValidCommand reports whether a command is made of letters or is a
+// three-digit numeric
+func isValidCommand(command string) bool {
+	if command == "" {
+		return false
+	}
+	digits := 0
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case (c < 'a' || c > 'z') && (c < 'A' || c > 'Z'):
+			return false
 		}
 	}
+	return digits == 0 || (digits == 3 && len(command) == 3)
+}
 
-	// Split the remaining message by spaces
-	parts := strings.SplitN(raw, " ", 2)
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid message format")
+// upperASCII upper-cases the ASCII letters of s, leaving other bytes alone
+func upperASCII(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 'a' && s[i] <= 'z' {
+			return strings.ToUpper(s)
+		}
 	}
-	command := parts[0]
-	rawParams := parts[1]
-
-	// Extract params and handle trailing params that start with ":"
-	var params []string
-	if strings.Contains(rawParams, " :") {
-		parts := strings.SplitN(rawParams, " :", 2)
-		params = append(strings.Split(parts[0], " "), parts[1])
-	} else {
-		params = strings.Split(rawParams, " ")
+	return s
+}
+
+// parseTags parses the tags of a message, without the leading '@'. When a
+// key is repeated the last value wins.
+func parseTags(s string) map[string]string {
+	var tags map[string]string
+	for s != "" {
+		var tag string
+		tag, s, _ = strings.Cut(s, ";")
+		key, value, _ := strings.Cut(tag, "=")
+		if key == "" {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[key] = unescapeTagValue(value)
 	}
+	return tags
+}
 
-	// Ensure the message ends with CRLF
-	if !strings.HasSuffix(params[len(params)-1], "\r\n") {
-		return nil, fmt.Errorf("message must end with CRLF")
+// tagEscapes maps the character following a backslash in a tag value to the
+// character it stands for
+var tagEscapes = map[byte]byte{':': ';', 's': ' ', '\\': '\\', 'r': '\r', 'n': '\n'}
+
+func unescapeTagValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var b strings.Builder
+	b.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		// A trailing backslash is dropped and an unknown escape stands for
+		// the character itself
+		if i++; i < len(value) {
+			if c, ok := tagEscapes[value[i]]; ok {
+				b.WriteByte(c)
+			} else {
+				b.WriteByte(value[i])
+			}
+		}
 	}
+	return b.String()
+}
 
-	// Clean up the CRLF from the last param
-	params[len(params)-1] = strings.TrimSuffix(params[len(params)-1], "\r\n")
+// String serializes the message as an IRC line without the line ending. Tags
+// are written in key order and the last parameter is written as a trailing
+// parameter when it needs to be.
+func (m *IRCMessage) String() string {
+	var b strings.Builder
+	if len(m.Tags) > 0 {
+		keys := make([]string, 0, len(m.Tags))
+		for key := range m.Tags {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
 
-	return &IRCMessage{
-		Prefix:  prefix,
-		Command: strings.ToUpper(command),
-		Params:  params,
-	}, nil
+		b.WriteByte('@')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(';')
+			}
+			b.WriteString(key)
+			if value := m.Tags[key]; value != "" {
+				b.WriteByte('=')
+				b.WriteString(models.EscapeTagValue(value))
+			}
+		}
+		b.WriteByte(' ')
+	}
+	if m.Prefix != "" {
+		b.WriteByte(':')
+		b.WriteString(m.Prefix)
+		b.WriteByte(' ')
+	}
+	b.WriteString(m.Command)
+	for i, param := range m.Params {
+		b.WriteByte(' ')
+		if i == len(m.Params)-1 && (param == "" || param[0] == ':' || strings.Contains(param, " ")) {
+			b.WriteByte(':')
+		}
+		b.WriteString(param)
+	}
+	return b.String()
 }
@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+// parserVectors are taken from the msg-split tests of the ircdocs
+// parser-tests suite, with the command upper-cased as Parse does
+var parserVectors = []struct {
+	input   string
+	tags    map[string]string
+	prefix  string
+	command string
+	params  []string
+}{
+	// Simple
+	{input: "foo bar baz asdf", command: "FOO", params: []string{"bar", "baz", "asdf"}},
+	// With source
+	{input: ":coolguy foo bar baz asdf", prefix: "coolguy", command: "FOO", params: []string{"bar", "baz", "asdf"}},
+	// With trailing param
+	{input: "foo bar baz :asdf quux", command: "FOO", params: []string{"bar", "baz", "asdf quux"}},
+	{input: "foo bar baz :", command: "FOO", params: []string{"bar", "baz", ""}},
+	{input: "foo bar baz ::asdf", command: "FOO", params: []string{"bar", "baz", ":asdf"}},
+	// With source and trailing param
+	{input: ":coolguy foo bar baz :asdf quux", prefix: "coolguy", command: "FOO", params: []string{"bar", "baz", "asdf quux"}},
+	{input: ":coolguy foo bar baz :  asdf quux ", prefix: "coolguy", command: "FOO", params: []string{"bar", "baz", "  asdf quux "}},
+	{input: ":coolguy PRIVMSG bar :lol :) ", prefix: "coolguy", command: "PRIVMSG", params: []string{"bar", "lol :) "}},
+	{input: ":coolguy foo bar baz :", prefix: "coolguy", command: "FOO", params: []string{"bar", "baz", ""}},
+	{input: ":coolguy foo bar baz :  ", prefix: "coolguy", command: "FOO", params: []string{"bar", "baz", "  "}},
+	// With tags
+	{input: "@a=b;c=32;k;rt=ql7 foo", tags: map[string]string{"a": "b", "c": "32", "k": "", "rt": "ql7"}, command: "FOO"},
+	// With escaped tags
+	{input: `@a=b\\and\nk;c=72\s45;d=gh\:764 foo`, tags: map[string]string{"a": "b\\and\nk", "c": "72 45", "d": "gh;764"}, command: "FOO"},
+	// With tags and source
+	{input: "@c;h=;a=b :quux ab cd", tags: map[string]string{"c": "", "h": "", "a": "b"}, prefix: "quux", command: "AB", params: []string{"cd"}},
+	// Different forms of last param
+	{input: ":src JOIN #chan", prefix: "src", command: "JOIN", params: []string{"#chan"}},
+	{input: ":src JOIN :#chan", prefix: "src", command: "JOIN", params: []string{"#chan"}},
+	// With and without last param
+	{input: ":src AWAY", prefix: "src", command: "AWAY"},
+	{input: ":src AWAY ", prefix: "src", command: "AWAY"},
+	// Tab is not considered whitespace
+	{input: ":cool\tguy foo bar baz", prefix: "cool\tguy", command: "FOO", params: []string{"bar", "baz"}},
+	// Source control characters
+	{input: ":coolguy!ag@net\x035w\x03ork.admin PRIVMSG foo :bar baz", prefix: "coolguy!ag@net\x035w\x03ork.admin", command: "PRIVMSG", params: []string{"foo", "bar baz"}},
+	{input: ":coolguy!~ag@n\x02et\x0305w\x0fork.admin PRIVMSG foo :bar baz", prefix: "coolguy!~ag@n\x02et\x0305w\x0fork.admin", command: "PRIVMSG", params: []string{"foo", "bar baz"}},
+	// Vendor tags
+	{
+		input:   "@tag1=value1;tag2;vendor1/tag3=value2;vendor2/tag4= :irc.example.com COMMAND param1 param2 :param3 param3",
+		tags:    map[string]string{"tag1": "value1", "tag2": "", "vendor1/tag3": "value2", "vendor2/tag4": ""},
+		prefix:  "irc.example.com",
+		command: "COMMAND",
+		params:  []string{"param1", "param2", "param3 param3"},
+	},
+	{input: ":irc.example.com COMMAND param1 param2 :param3 param3", prefix: "irc.example.com", command: "COMMAND", params: []string{"param1", "param2", "param3 param3"}},
+	{
+		input:   "@tag1=value1;tag2;vendor1/tag3=value2;vendor2/tag4 COMMAND param1 param2 :param3 param3",
+		tags:    map[string]string{"tag1": "value1", "tag2": "", "vendor1/tag3": "value2", "vendor2/tag4": ""},
+		command: "COMMAND",
+		params:  []string{"param1", "param2", "param3 param3"},
+	},
+	{input: "COMMAND", command: "COMMAND"},
+	// Escaped characters in tag values
+	{input: `@foo=\\\\\:\\s\s\r\n COMMAND`, tags: map[string]string{"foo": "\\\\;\\s \r\n"}, command: "COMMAND"},
+	// Broken messages from unreal
+	{input: ":gravel.mozilla.org 432  #momo :Erroneous Nickname: Illegal characters", prefix: "gravel.mozilla.org", command: "432", params: []string{"#momo", "Erroneous Nickname: Illegal characters"}},
+	{input: ":gravel.mozilla.org MODE #tckk +n ", prefix: "gravel.mozilla.org", command: "MODE", params: []string{"#tckk", "+n"}},
+	{input: ":services.esper.net MODE #foo-bar +o foobar  ", prefix: "services.esper.net", command: "MODE", params: []string{"#foo-bar", "+o", "foobar"}},
+	// Tag values should be parsed char-at-a-time to prevent wayward replacements
+	{input: `@tag1=value\\ntest COMMAND`, tags: map[string]string{"tag1": `value\ntest`}, command: "COMMAND"},
+	// An invalid escape drops the backslash
+	{input: `@tag1=value\1 COMMAND`, tags: map[string]string{"tag1": "value1"}, command: "COMMAND"},
+	// A trailing backslash is dropped
+	{input: `@tag1=value1\ COMMAND`, tags: map[string]string{"tag1": "value1"}, command: "COMMAND"},
+	// Duplicate tags: the last value wins
+	{input: "@tag1=1;tag2=3;tag3=4;tag1=5 COMMAND", tags: map[string]string{"tag1": "5", "tag2": "3", "tag3": "4"}, command: "COMMAND"},
+	{input: "@tag1=1;tag2=3;tag3=4;tag1=5;vendor/tag2=8 COMMAND", tags: map[string]string{"tag1": "5", "tag2": "3", "tag3": "4", "vendor/tag2": "8"}, command: "COMMAND"},
+	// Mode strings
+	{input: ":SomeOp MODE #channel :+i", prefix: "SomeOp", command: "MODE", params: []string{"#channel", "+i"}},
+	{input: ":SomeOp MODE #channel +oo SomeUser :AnotherUser", prefix: "SomeOp", command: "MODE", params: []string{"#channel", "+oo", "SomeUser", "AnotherUser"}},
+}
+
+func TestParseVectors(t *testing.T) {
+	parser := NewProtocolParser()
+	for _, tt := range parserVectors {
+		msg, err := parser.Parse(tt.input)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(msg.Tags, tt.tags) || msg.Prefix != tt.prefix || msg.Command != tt.command || !reflect.DeepEqual(msg.Params, tt.params) {
+			t.Errorf("Parse(%q) = %+v, want tags %v, prefix %q, command %q, params %q",
+				tt.input, msg, tt.tags, tt.prefix, tt.command, tt.params)
+		}
+	}
+}
+
+func TestParseLineEndings(t *testing.T) {
+	parser := NewProtocolParser()
+	for _, input := range []string{"QUIT :bye\r\n", "QUIT :bye\n", "QUIT :bye"} {
+		msg, err := parser.Parse(input)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", input, err)
+			continue
+		}
+		if msg.Command != "QUIT" || !reflect.DeepEqual(msg.Params, []string{"bye"}) {
+			t.Errorf("Parse(%q) = %+v", input, msg)
+		}
+	}
+
+	msg, err := parser.Parse("MOTD\r\n")
+	if err != nil || msg.Command != "MOTD" || len(msg.Params) != 0 {
+		t.Errorf("Expected a command without params to parse, got %+v, %v", msg, err)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	parser := NewProtocolParser()
+	for _, input := range []string{"", "\r\n", ":", ":prefix", ":prefix ", "@a=b", "@a=b :prefix", " PING", "PRIVMSG a\rb", "PRIVMSG a :b\x00c", "@ @", "PRIV/MSG a", "1234"} {
+		if msg, err := parser.Parse(input); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", input, msg)
+		}
+	}
+}
+
+// serializerVectors are taken from the msg-join tests of the ircdocs
+// parser-tests suite
+var serializerVectors = []struct {
+	msg    IRCMessage
+	output string
+}{
+	{IRCMessage{Command: "foo", Params: []string{"bar", "baz", "asdf"}}, "foo bar baz asdf"},
+	{IRCMessage{Prefix: "coolguy", Command: "foo", Params: []string{"bar", "baz", "asdf"}}, ":coolguy foo bar baz asdf"},
+	{IRCMessage{Command: "foo", Params: []string{"bar", "baz", "asdf quux"}}, "foo bar baz :asdf quux"},
+	{IRCMessage{Command: "foo", Params: []string{"bar", "baz", ""}}, "foo bar baz :"},
+	{IRCMessage{Command: "foo", Params: []string{"bar", "baz", ":asdf"}}, "foo bar baz ::asdf"},
+	{IRCMessage{Prefix: "coolguy", Command: "foo", Params: []string{"bar", "baz", "  asdf quux "}}, ":coolguy foo bar baz :  asdf quux "},
+	{IRCMessage{Prefix: "coolguy", Command: "PRIVMSG", Params: []string{"bar", "lol :) "}}, ":coolguy PRIVMSG bar :lol :) "},
+	{IRCMessage{Tags: map[string]string{"a": "b", "c": "32", "k": "", "rt": "ql7"}, Command: "foo"}, "@a=b;c=32;k;rt=ql7 foo"},
+	{IRCMessage{Tags: map[string]string{"a": "b\\and\nk", "c": "72 45", "d": "gh;764"}, Command: "foo"}, `@a=b\\and\nk;c=72\s45;d=gh\:764 foo`},
+	{IRCMessage{Tags: map[string]string{"a": "b", "c": "", "h": ""}, Prefix: "quux", Command: "ab", Params: []string{"cd"}}, "@a=b;c;h :quux ab cd"},
+}
+
+func TestSerializeVectors(t *testing.T) {
+	for _, tt := range serializerVectors {
+		if got := tt.msg.String(); got != tt.output {
+			t.Errorf("String() = %q, want %q", got, tt.output)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, tt := range parserVectors {
+		f.Add(tt.input)
+	}
+	f.Add("PRIVMSG #chan :hello world\r\n")
+
+	parser := NewProtocolParser()
+	f.Fuzz(func(t *testing.T, input string) {
+		msg, err := parser.Parse(input)
+		if err != nil {
+			return
+		}
+		// Serializing a parsed message must give a line that parses back to
+		// the same message
+		line := msg.String()
+		again, err := parser.Parse(line)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed on the serialized form of %q: %v", line, input, err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("Round trip of %q through %q gave %+v, want %+v", input, line, again, msg)
+		}
+	})
+}
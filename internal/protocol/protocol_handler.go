@@ -3,25 +3,80 @@ package protocol
 import (
 	"fmt"
 	"log"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/exogmi/gossip/internal/models"
 	"github.com/exogmi/gossip/internal/state"
 )
 
+// supportedCapabilities lists the IRCv3 capabilities the server can negotiate
+var supportedCapabilities = []string{"account-notify", "account-tag", "batch", "chghost", "echo-message", "extended-join", "invite-notify",
+	"labeled-response", "multi-prefix", "sasl", "setname", "userhost-in-names"}
+
+// capabilityValues holds the values advertised with CAP LS 302
+var capabilityValues = map[string]string{"sasl": "PLAIN"}
+
+// inviteTimeout is how long an unused invitation remains valid
+const inviteTimeout = time.Hour
+
 type ProtocolHandler struct {
 	stateManager *state.StateManager
 	user         *models.User
+	session      models.ClientSession
+	capabilities map[string]bool
+	capMutex     sync.RWMutex
+	registration registration
+	registered   atomic.Bool
+	closeReason  string
+
+	// labeled holds the replies streamed while answering a labeled command,
+	// which all go out together once the command is done
+	labeled   []string
+	labelling bool
 }
 
 func NewProtocolHandler(stateManager *state.StateManager) *ProtocolHandler {
 	return &ProtocolHandler{
 		stateManager: stateManager,
+		capabilities: make(map[string]bool),
+	}
+}
+
+// SetSession sets the client session the handler answers, so long replies
+// can be streamed to it instead of being returned at once
+func (ph *ProtocolHandler) SetSession(session models.ClientSession) {
+	ph.session = session
+}
+
+// send streams a reply to the handler's own session. Replies sent this way
+// go out before those returned from HandleCommand.
+func (ph *ProtocolHandler) send(line string) {
+	if ph.labelling {
+		ph.labeled = append(ph.labeled, line)
+		return
+	}
+	if ph.session == nil {
+		return
+	}
+	if err := ph.session.SendMessage(line); err != nil {
+		log.Printf("Failed to send reply: %v", err)
 	}
 }
 
+// HasCapability reports whether the client negotiated the given capability
+func (ph *ProtocolHandler) HasCapability(name string) bool {
+	ph.capMutex.RLock()
+	defer ph.capMutex.RUnlock()
+	return ph.capabilities[name]
+}
+
 func (ph *ProtocolHandler) HandleCommand(user *models.User, message *IRCMessage) ([]string, error) {
 	if ph == nil {
 		return nil, fmt.Errorf("ProtocolHandler is nil")
@@ -32,7 +87,40 @@ func (ph *ProtocolHandler) HandleCommand(user *models.User, message *IRCMessage)
 
 	log.Printf("Handling command: %s", message.Command)
 
+	label := ph.labelOf(message)
+	if label != "" {
+		ph.labelling = true
+		defer func() { ph.labeled, ph.labelling = nil, false }()
+	}
+
+	var replies []string
+	var err error
+	if !ph.IsRegistered() && !allowedBeforeRegistration(message.Command) {
+		replies, err = ph.reportError(nil, errNotRegistered())
+	} else {
+		replies, err = ph.reportError(ph.dispatch(user, message))
+	}
+	if label != "" {
+		// A labeled command always gets a labeled response, a failure
+		// included
+		if err != nil {
+			log.Printf("Error handling labeled command %s: %v", message.Command, err)
+			replies, err = ph.reportError(replies, fail(message.Command, "UNKNOWN_ERROR", "Could not process the command"))
+		}
+		replies = ph.labelReplies(label, append(ph.labeled, replies...))
+	}
+	return replies, err
+}
+
+// dispatch runs the handler of a command
+func (ph *ProtocolHandler) dispatch(user *models.User, message *IRCMessage) ([]string, error) {
 	switch message.Command {
+	case "PASS":
+		return ph.handlePassCommand(message.Params)
+	case "AUTHENTICATE":
+		return ph.handleAuthenticateCommand(message.Params)
+	case "PING":
+		return ph.handlePingCommand(message.Params)
 	case "NICK":
 		return ph.handleNickCommand(message.Params)
 	case "USER":
@@ -43,6 +131,8 @@ func (ph *ProtocolHandler) HandleCommand(user *models.User, message *IRCMessage)
 		return ph.handlePartCommand(user, message.Params)
 	case "PRIVMSG":
 		return ph.handlePrivmsgCommand(user, message.Params)
+	case "NOTICE":
+		return ph.handleNoticeCommand(user, message.Params)
 	case "QUIT":
 		return ph.handleQuitCommand(user, message.Params)
 	case "CAP":
@@ -51,22 +141,58 @@ func (ph *ProtocolHandler) HandleCommand(user *models.User, message *IRCMessage)
 		return ph.handlePongCommand(user, message.Params)
 	case "TOPIC":
 		return ph.handleTopicCommand(user, message.Params)
+	case "TOPICHISTORY":
+		return ph.handleTopicHistoryCommand(user, message.Params)
 	case "ISON":
 		return ph.handleIsonCommand(user, message.Params)
+	case "MONITOR":
+		return ph.handleMonitorCommand(user, message.Params)
 	case "MODE":
 		return ph.handleModeCommand(user, message.Params)
 	case "KICK":
 		return ph.handleKickCommand(user, message.Params)
+	case "INVITE":
+		return ph.handleInviteCommand(user, message.Params)
+	case "WHO":
+		return ph.handleWhoCommand(user, message.Params)
+	case "LIST":
+		return ph.handleListCommand(user, message.Params)
+	case "NAMES":
+		return ph.handleNamesCommand(user, message.Params)
+	case "MOTD":
+		return ph.handleMotdCommand(user, message.Params)
+	case "LUSERS":
+		return ph.handleLusersCommand(user, message.Params)
+	case "VERSION":
+		return ph.handleVersionCommand(user, message.Params)
+	case "TIME":
+		return ph.handleTimeCommand(user, message.Params)
+	case "ADMIN":
+		return ph.handleAdminCommand(user, message.Params)
+	case "INFO":
+		return ph.handleInfoCommand(user, message.Params)
+	case "WHOIS":
+		return ph.handleWhoisCommand(user, message.Params)
+	case "WHOWAS":
+		return ph.handleWhowasCommand(user, message.Params)
+	case "AWAY":
+		return ph.handleAwayCommand(user, message.Params)
+	case "SETNAME":
+		return ph.handleSetnameCommand(user, message.Params)
 	case "BAN":
 		return ph.handleBanCommand(user, message.Params)
+	case "NICKSERV", "NS":
+		return ph.handleNickServCommand(user, message.Params)
+	case "CHANSERV", "CS":
+		return ph.handleChanServCommand(user, message.Params)
 	default:
-		return nil, fmt.Errorf("unknown command: %s", message.Command)
+		return nil, errUnknownCommand(message.Command)
 	}
 }
 
 func (ph *ProtocolHandler) handleModeCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 1 {
-		return []string{fmt.Sprintf(":%s 461 %s MODE :Not enough parameters", ph.stateManager.ServerName, user.Nickname)}, nil
+		return nil, errNeedMoreParams("MODE")
 	}
 
 	targetName := params[0]
@@ -74,7 +200,7 @@ func (ph *ProtocolHandler) handleModeCommand(user *models.User, params []string)
 
 	if err == nil { // Channel exists
 		if len(params) < 2 {
-			modes := "+"
+			modes := channel.ModeString()
 			if channel.Key != "" {
 				modes += "k"
 				if user.IsInChannel(channel.Name) {
@@ -88,29 +214,73 @@ func (ph *ProtocolHandler) handleModeCommand(user *models.User, params []string)
 		switch flag {
 		case "+k", "-k":
 			return ph.handleChannelKeyMode(user, channel, flag, params)
-		case "+o", "-o", "+v", "-v":
+		case "b", "+b", "-b":
+			return ph.handleChannelBanMode(user, channel, flag, params)
+		case "+q", "-q", "+a", "-a", "+o", "-o", "+h", "-h", "+v", "-v":
 			return ph.handleChannelUserMode(user, channel, flag, params)
+		case "+i", "-i", "+m", "-m", "+n", "-n", "+p", "-p", "+s", "-s", "+t", "-t":
+			return ph.handleChannelFlagMode(user, channel, flag)
 		default:
-			return []string{fmt.Sprintf(":%s 472 %s %s :Unknown MODE flag", ph.stateManager.ServerName, user.Nickname, flag)}, nil
+			return nil, errUnknownMode(strings.TrimLeft(flag, "+-"))
 		}
-	} else if targetName == user.Nickname {
+	} else if models.NamesEqual(targetName, user.Nickname) {
 		if len(params) == 1 {
-			return []string{fmt.Sprintf(":%s 221 %s +", ph.stateManager.ServerName, user.Nickname)}, nil
+			return []string{fmt.Sprintf(":%s 221 %s %s", ph.stateManager.ServerName, user.Nickname, userModeString(user))}, nil
 		}
-		return []string{fmt.Sprintf(":%s 501 %s :Unknown MODE flag", ph.stateManager.ServerName, user.Nickname)}, nil
+		return ph.handleUserMode(user, params[1])
+	} else if isChannelName(targetName) {
+		return nil, errNoSuchChannel(targetName)
+	} else if ph.stateManager.UserManager.UserExists(targetName) {
+		return nil, errUsersDontMatch()
 	} else {
-		return []string{fmt.Sprintf(":%s 403 %s :No such channel", ph.stateManager.ServerName, targetName)}, nil
+		return nil, errNoSuchNick(targetName)
+	}
+}
+
+// handleUserMode applies the user modes a user may set on themselves (+i)
+func (ph *ProtocolHandler) handleUserMode(user *models.User, flags string) ([]string, error) {
+	if len(flags) < 2 || (flags[0] != '+' && flags[0] != '-') {
+		return nil, errUModeUnknownFlag()
+	}
+	for _, mode := range flags[1:] {
+		if mode != 'i' {
+			return nil, errUModeUnknownFlag()
+		}
 	}
+
+	user.SetMode("i", flags[0] == '+')
+	msg := fmt.Sprintf(":%s MODE %s %ci", user.Nickname, user.Nickname, flags[0])
+	user.BroadcastToOtherSessions(msg, ph.session)
+	return []string{msg}, nil
+}
+
+// userModeString returns the modes set on a user, e.g. "+i"
+func userModeString(user *models.User) string {
+	modes := "+"
+	if user.Modes.Away {
+		modes += "a"
+	}
+	if user.Modes.Invisible {
+		modes += "i"
+	}
+	if user.Modes.Operator {
+		modes += "o"
+	}
+	return modes
 }
 
 func (ph *ProtocolHandler) handleChannelKeyMode(user *models.User, channel *models.Channel, flag string, params []string) ([]string, error) {
 	if !user.IsInChannel(channel.Name) {
-		return []string{fmt.Sprintf(":%s 442 %s :You're not on that channel", ph.stateManager.ServerName, channel.Name)}, nil
+		return nil, errNotOnChannel(channel.Name)
+	}
+
+	if !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channel.Name)
 	}
 
 	if flag == "+k" {
 		if len(params) < 3 {
-			return []string{fmt.Sprintf(":%s 461 %s MODE :Not enough parameters", ph.stateManager.ServerName, user.Nickname)}, nil
+			return nil, errNeedMoreParams("MODE")
 		}
 		key := params[2]
 		channel.Key = key
@@ -119,7 +289,7 @@ func (ph *ProtocolHandler) handleChannelKeyMode(user *models.User, channel *mode
 			Sender:  user,
 			Content: msg,
 			Type:    models.ServerMessage,
-		}, nil)
+		}, ph.session)
 		return []string{msg}, nil
 	} else { // -k
 		channel.Key = ""
@@ -128,94 +298,250 @@ func (ph *ProtocolHandler) handleChannelKeyMode(user *models.User, channel *mode
 			Sender:  user,
 			Content: msg,
 			Type:    models.ServerMessage,
-		}, nil)
+		}, ph.session)
 		return []string{msg}, nil
 	}
 }
 
+// handleChannelBanMode lists the ban list, or adds or removes a ban mask
+func (ph *ProtocolHandler) handleChannelBanMode(user *models.User, channel *models.Channel, flag string, params []string) ([]string, error) {
+	if len(params) < 3 {
+		replies := []string{}
+		for _, mask := range channel.BanList {
+			replies = append(replies, fmt.Sprintf(":%s 367 %s %s %s", ph.stateManager.ServerName, user.Nickname, channel.Name, mask))
+		}
+		return append(replies, fmt.Sprintf(":%s 368 %s %s :End of channel ban list", ph.stateManager.ServerName, user.Nickname, channel.Name)), nil
+	}
+
+	if !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channel.Name)
+	}
+
+	// A mode without a direction is added, as in MODE #chan b mask
+	if flag == "b" {
+		flag = "+b"
+	}
+	mask := params[2]
+	if flag == "+b" && !channel.AddBan(mask) || flag == "-b" && !channel.RemoveBan(mask) {
+		return nil, nil
+	}
+
+	msg := fmt.Sprintf(":%s MODE %s %s %s", user.Hostmask(), channel.Name, flag, mask)
+	ph.stateManager.ChannelManager.BroadcastToChannel(channel, &models.Message{
+		Sender:  user,
+		Content: msg,
+		Type:    models.ServerMessage,
+	}, ph.session)
+
+	return []string{msg}, nil
+}
+
+func (ph *ProtocolHandler) handleChannelFlagMode(user *models.User, channel *models.Channel, flag string) ([]string, error) {
+	if !user.IsInChannel(channel.Name) {
+		return nil, errNotOnChannel(channel.Name)
+	}
+
+	if !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channel.Name)
+	}
+
+	if err := channel.SetMode(flag[1:], flag[0] == '+'); err != nil {
+		return nil, errUnknownMode(strings.TrimLeft(flag, "+-"))
+	}
+
+	msg := fmt.Sprintf(":%s MODE %s %s", user.Hostmask(), channel.Name, flag)
+	ph.stateManager.ChannelManager.BroadcastToChannel(channel, &models.Message{
+		Sender:  user,
+		Content: msg,
+		Type:    models.ServerMessage,
+	}, ph.session)
+
+	return []string{msg}, nil
+}
+
 func (ph *ProtocolHandler) handleChannelUserMode(user *models.User, channel *models.Channel, flag string, params []string) ([]string, error) {
 	if len(params) < 3 {
-		return []string{fmt.Sprintf(":%s 461 %s MODE :Not enough parameters", ph.stateManager.ServerName, user.Nickname)}, nil
+		return nil, errNeedMoreParams("MODE")
 	}
 
-	if !user.IsInChannel(channel.Name) || !channel.Operators[user.Nickname] {
-		return []string{fmt.Sprintf(":%s 482 %s %s :You're not channel operator", ph.stateManager.ServerName, user.Nickname, channel.Name)}, nil
+	privilege, _ := models.PrivilegeFromMode(flag[1:])
+	if !user.IsInChannel(channel.Name) || !channel.CanGrant(user.ID, privilege) {
+		return nil, errChanOPrivsNeeded(channel.Name)
 	}
 
 	targetUser := params[2]
-	switch flag {
-	case "+o", "-o":
-		channel.Operators[targetUser] = (flag == "+o")
-	case "+v", "-v":
-		channel.Voices[targetUser] = (flag == "+v")
+	target, err := ph.stateManager.GetUser(targetUser)
+	if err != nil {
+		return nil, errNoSuchNick(targetUser)
+	}
+	if !channel.HasMember(target.ID) {
+		return nil, errUserNotInChannel(targetUser, channel.Name)
 	}
 
+	// Members cannot change the privileges of someone ranked above them
+	if target != user && channel.HighestPrivilege(target.ID) > channel.HighestPrivilege(user.ID) {
+		return nil, errChanRankTooLow(channel.Name, "You cannot change the privileges of a higher ranked member")
+	}
+
+	channel.SetPrivilege(target.ID, privilege, flag[0] == '+')
+
 	msg := fmt.Sprintf(":%s!%s@%s MODE %s %s %s", user.Nickname, user.Username, user.Host, channel.Name, flag, targetUser)
 	ph.stateManager.ChannelManager.BroadcastToChannel(channel, &models.Message{
 		Sender:  user,
 		Content: msg,
 		Type:    models.ServerMessage,
-	}, nil)
+	}, ph.session)
 
 	// Log mode change
 	log.Printf("Mode change in channel %s: %s sets %s on %s", channel.Name, user.Nickname, flag, targetUser)
 
-	// Update user list for all users in the channel
-	userList := channel.GetUserList()
-	for _, u := range channel.Users {
-		u.BroadcastToSessions(fmt.Sprintf(":%s 353 %s = %s :%s", ph.stateManager.ServerName, u.Nickname, channel.Name, strings.Join(userList, " ")))
-		u.BroadcastToSessions(fmt.Sprintf(":%s 366 %s %s :End of /NAMES list", ph.stateManager.ServerName, u.Nickname, channel.Name))
-	}
-
 	return []string{msg}, nil
 }
 
+func (ph *ProtocolHandler) handlePingCommand(params []string) ([]string, error) {
+	if len(params) < 1 {
+		return nil, errNeedMoreParams("PING")
+	}
+	return []string{fmt.Sprintf(":%s PONG %s :%s", ph.stateManager.ServerName, ph.stateManager.ServerName, params[0])}, nil
+}
+
 func (ph *ProtocolHandler) handlePongCommand(user *models.User, params []string) ([]string, error) {
 	// PONG command doesn't require any action, just log it if needed
-	log.Printf("Received PONG from user %s", user.Nickname)
+	log.Printf("Received PONG from user %s", ph.clientName())
 	return nil, nil
 }
 
 func (ph *ProtocolHandler) handleTopicCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 1 {
-		return []string{fmt.Sprintf(":%s 461 %s TOPIC :Not enough parameters", ph.stateManager.ServerName, user.Nickname)}, nil
+		return nil, errNeedMoreParams("TOPIC")
 	}
 
 	channelName := params[0]
 	channel, err := ph.stateManager.ChannelManager.GetChannel(channelName)
 	if err != nil {
-		return []string{fmt.Sprintf(":%s 403 %s %s :No such channel", ph.stateManager.ServerName, user.Nickname, channelName)}, nil
+		return nil, errNoSuchChannel(channelName)
+	}
+
+	if !user.IsInChannel(channel.Name) {
+		// The topic of a secret or private channel is for its members only,
+		// and a secret channel does not exist for others
+		if channel.Modes.Secret {
+			return nil, errNoSuchChannel(channelName)
+		}
+		if len(params) > 1 || channel.Modes.Private {
+			return nil, errNotOnChannel(channelName)
+		}
 	}
 
 	if len(params) == 1 {
 		// User is requesting the current topic
-		if channel.Topic == "" {
-			return []string{fmt.Sprintf(":%s 331 %s %s :No topic is set", ph.stateManager.ServerName, user.Nickname, channelName)}, nil
-		}
-		return []string{fmt.Sprintf(":%s 332 %s %s :%s", ph.stateManager.ServerName, user.Nickname, channelName, channel.Topic)}, nil
+		return ph.stateManager.ChannelManager.TopicReplies(user, channel), nil
 	}
 
-	// User is setting a new topic
-	newTopic := strings.Join(params[1:], " ")
-	if strings.HasPrefix(newTopic, ":") {
-		newTopic = newTopic[1:]
+	if channel.Modes.TopicSettableOnlyByOps && !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channelName)
 	}
-	channel.SetTopic(newTopic)
 
-	// Broadcast the topic change to all users in the channel
-	topicChangeMsg := fmt.Sprintf(":%s!%s@%s TOPIC %s :%s", user.Nickname, user.Username, user.Host, channelName, newTopic)
+	// User is setting a new topic
+	return []string{ph.setTopic(user, channel, params[1])}, nil
+}
+
+// setTopic changes a channel's topic, broadcasts the change to the members and
+// returns it for the user who set it
+func (ph *ProtocolHandler) setTopic(user *models.User, channel *models.Channel, topic string) string {
+	topic = truncate(topic, ph.stateManager.Config.TopicLength)
+	channel.SetTopic(topic, user.Hostmask())
+
+	topicChangeMsg := fmt.Sprintf(":%s TOPIC %s :%s", user.Hostmask(), channel.Name, topic)
 	ph.stateManager.ChannelManager.BroadcastToChannel(channel, &models.Message{
 		Sender:  user,
 		Content: topicChangeMsg,
 		Type:    models.ServerMessage,
-	}, nil)
+	}, ph.session)
+	return topicChangeMsg
+}
+
+func (ph *ProtocolHandler) handleTopicHistoryCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 1 {
+		return nil, errNeedMoreParams("TOPICHISTORY")
+	}
+
+	channel, err := ph.stateManager.ChannelManager.GetChannel(params[0])
+	if err != nil {
+		return nil, errNoSuchChannel(params[0])
+	}
 
-	return []string{topicChangeMsg}, nil
+	if !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channel.Name)
+	}
+
+	history := channel.TopicHistory
+	if len(params) == 1 {
+		// Entries are numbered from the most recent topic
+		replies := []string{}
+		for i := len(history) - 1; i >= 0; i-- {
+			entry := history[i]
+			replies = append(replies, fmt.Sprintf(":%s NOTICE %s :%s [%d] set by %s on %s: %s", ph.stateManager.ServerName, user.Nickname,
+				channel.Name, len(history)-i, entry.SetBy, entry.SetAt.Format(time.RFC1123), entry.Topic))
+		}
+		return append(replies, fmt.Sprintf(":%s NOTICE %s :%s End of topic history", ph.stateManager.ServerName, user.Nickname, channel.Name)), nil
+	}
+
+	if strings.ToUpper(params[1]) != "RESTORE" || len(params) < 3 {
+		return nil, fail("TOPICHISTORY", "INVALID_PARAMS", "Syntax: TOPICHISTORY <channel> [RESTORE <number>]")
+	}
+
+	index, err := strconv.Atoi(params[2])
+	if err != nil || index < 1 || index > len(history) {
+		return nil, fail("TOPICHISTORY", "INVALID_ENTRY", "No such topic history entry", channel.Name, params[2])
+	}
+
+	return []string{ph.setTopic(user, channel, history[len(history)-index].Topic)}, nil
+}
+
+func (ph *ProtocolHandler) handleAwayCommand(user *models.User, params []string) ([]string, error) {
+	message := ""
+	if len(params) > 0 {
+		message = truncate(params[0], ph.stateManager.Config.AwayLength)
+	}
+	user.SetAway(message)
+
+	if message == "" {
+		return []string{fmt.Sprintf(":%s 305 %s :You are no longer marked as being away", ph.stateManager.ServerName, user.Nickname)}, nil
+	}
+	return []string{fmt.Sprintf(":%s 306 %s :You have been marked as being away", ph.stateManager.ServerName, user.Nickname)}, nil
+}
+
+// handleSetnameCommand changes the user's realname, telling the sessions that
+// negotiated setname and share a channel with the user
+func (ph *ProtocolHandler) handleSetnameCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 1 {
+		return nil, errNeedMoreParams("SETNAME")
+	}
+	realname := params[0]
+	if realname == "" || len(realname) > ph.stateManager.Config.NameLength {
+		return nil, fail("SETNAME", "INVALID_REALNAME", "Realname is not valid")
+	}
+	user.Realname = realname
+
+	line := fmt.Sprintf(":%s SETNAME :%s", user.Hostmask(), realname)
+	render := func(session models.ClientSession) string {
+		if !session.HasCapability("setname") {
+			return ""
+		}
+		return models.TagAccount(line, user, session)
+	}
+	ph.stateManager.ChannelManager.SendToNeighbors(user, render, ph.session)
+
+	if !ph.HasCapability("setname") {
+		return nil, nil
+	}
+	return []string{models.TagAccount(line, user, ph.session)}, nil
 }
 
 func (ph *ProtocolHandler) handleIsonCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 1 {
-		return []string{fmt.Sprintf(":%s 461 %s ISON :Not enough parameters", ph.stateManager.ServerName, user.Nickname)}, nil
+		return nil, errNeedMoreParams("ISON")
 	}
 
 	onlineUsers := []string{}
@@ -230,72 +556,156 @@ func (ph *ProtocolHandler) handleIsonCommand(user *models.User, params []string)
 
 func (ph *ProtocolHandler) handleKickCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 2 {
-		return []string{fmt.Sprintf(":%s 461 %s KICK :Not enough parameters", ph.stateManager.ServerName, user.Nickname)}, nil
+		return nil, errNeedMoreParams("KICK")
 	}
 
-	channelName, targetNick := params[0], params[1]
+	channelName := params[0]
+	targets := strings.Split(params[1], ",")
 	reason := "No reason given"
 	if len(params) > 2 {
-		reason = strings.Join(params[2:], " ")
+		reason = truncate(params[2], ph.stateManager.Config.KickLength)
+	}
+	if len(targets) > ph.stateManager.Config.MaxTargets {
+		return nil, errTooManyTargets(params[1])
 	}
 
 	channel, err := ph.stateManager.GetChannel(channelName)
 	if err != nil {
-		return []string{fmt.Sprintf(":%s 403 %s %s :No such channel", ph.stateManager.ServerName, user.Nickname, channelName)}, nil
+		return nil, errNoSuchChannel(channelName)
 	}
 
-	if !channel.Operators[user.Nickname] {
-		return []string{fmt.Sprintf(":%s 482 %s %s :You're not channel operator", ph.stateManager.ServerName, user.Nickname, channelName)}, nil
+	if !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channelName)
 	}
 
+	var replies []string
+	for _, targetNick := range targets {
+		if targetNick == "" {
+			continue
+		}
+		reply, err := ph.kickUser(user, channel, targetNick, reason)
+		if replies, err = ph.reportError(append(replies, reply...), err); err != nil {
+			log.Printf("Failed to kick %s from %s: %v", targetNick, channel.Name, err)
+		}
+	}
+	return replies, nil
+}
+
+// kickUser removes a member from a channel, telling every member including
+// the one kicked, and returns the KICK for the kicker
+func (ph *ProtocolHandler) kickUser(user *models.User, channel *models.Channel, targetNick, reason string) ([]string, error) {
 	targetUser, err := ph.stateManager.GetUser(targetNick)
 	if err != nil {
-		return []string{fmt.Sprintf(":%s 401 %s %s :No such nick", ph.stateManager.ServerName, user.Nickname, targetNick)}, nil
+		return nil, errNoSuchNick(targetNick)
 	}
 
-	if !targetUser.IsInChannel(channelName) {
-		return []string{fmt.Sprintf(":%s 441 %s %s %s :They aren't on that channel", ph.stateManager.ServerName, user.Nickname, targetNick, channelName)}, nil
+	if !targetUser.IsInChannel(channel.Name) {
+		return nil, errUserNotInChannel(targetNick, channel.Name)
 	}
 
-	if err := ph.stateManager.ChannelManager.LeaveChannel(targetUser, channelName); err != nil {
-		return []string{fmt.Sprintf(":%s 491 %s %s :Could not kick user", ph.stateManager.ServerName, user.Nickname, targetNick)}, nil
+	if !channel.CanKick(user.ID, targetUser.ID) {
+		return nil, errChanRankTooLow(channel.Name, "You cannot kick a member of equal or higher rank")
 	}
-	kickMsg := fmt.Sprintf(":%s!%s@%s KICK %s %s :%s", user.Nickname, user.Username, user.Host, channelName, targetNick, reason)
+
+	kickMsg := fmt.Sprintf(":%s KICK %s %s :%s", user.Hostmask(), channel.Name, targetUser.Nickname, reason)
 	ph.stateManager.ChannelManager.BroadcastToChannel(channel, &models.Message{
 		Sender:  user,
 		Content: kickMsg,
 		Type:    models.ServerMessage,
-	}, nil)
-
-	// Send the kick message to the kicked user
-	targetUser.BroadcastToSessions(kickMsg)
+	}, ph.session)
 
+	if err := ph.stateManager.ChannelManager.LeaveChannel(targetUser, channel.Name); err == state.ErrNotOnChannel {
+		return nil, errUserNotInChannel(targetNick, channel.Name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to kick user: %w", err)
+	}
 	return []string{kickMsg}, nil
 }
 
+func (ph *ProtocolHandler) handleInviteCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) == 0 {
+		// List the invitations pending for the user
+		replies := []string{}
+		for _, channel := range ph.stateManager.ChannelManager.InvitedChannels(user) {
+			replies = append(replies, fmt.Sprintf(":%s 336 %s %s", ph.stateManager.ServerName, user.Nickname, channel.Name))
+		}
+		return append(replies, fmt.Sprintf(":%s 337 %s :End of /INVITE list", ph.stateManager.ServerName, user.Nickname)), nil
+	}
+
+	if len(params) < 2 {
+		return nil, errNeedMoreParams("INVITE")
+	}
+
+	targetNick, channelName := params[0], params[1]
+
+	targetUser, err := ph.stateManager.GetUser(targetNick)
+	if err != nil {
+		return nil, errNoSuchNick(targetNick)
+	}
+
+	channel, err := ph.stateManager.GetChannel(channelName)
+	if err != nil {
+		return nil, errNoSuchChannel(channelName)
+	}
+
+	if !channel.HasMember(user.ID) {
+		return nil, errNotOnChannel(channel.Name)
+	}
+
+	if channel.Modes.InviteOnly && !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channel.Name)
+	}
+
+	if channel.HasMember(targetUser.ID) {
+		return nil, errUserOnChannel(targetUser.Nickname, channel.Name)
+	}
+
+	channel.AddInvite(targetUser, user.Nickname, inviteTimeout)
+	log.Printf("User %s invited %s to channel %s", user.Nickname, targetUser.Nickname, channel.Name)
+
+	// Deliver the invitation to every session of the invited user
+	inviteMsg := fmt.Sprintf(":%s INVITE %s %s", user.Hostmask(), targetUser.Nickname, channel.Name)
+	targetUser.BroadcastToSessions(inviteMsg)
+
+	// Let the channel's operators know through invite-notify
+	for _, member := range channel.Members {
+		if member.User == user || member.HighestPrivilege() < models.PrivilegeHalfOp {
+			continue
+		}
+		member.User.SendToSessions(func(session models.ClientSession) string {
+			if !session.HasCapability("invite-notify") {
+				return ""
+			}
+			return inviteMsg
+		})
+	}
+
+	return []string{fmt.Sprintf(":%s 341 %s %s %s", ph.stateManager.ServerName, user.Nickname, targetUser.Nickname, channel.Name)}, nil
+}
+
 func (ph *ProtocolHandler) handleBanCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 2 {
-		return []string{fmt.Sprintf(":%s 461 %s BAN :Not enough parameters", ph.stateManager.ServerName, user.Nickname)}, nil
+		return nil, errNeedMoreParams("BAN")
 	}
 
 	channelName, targetMask := params[0], params[1]
 
 	channel, err := ph.stateManager.GetChannel(channelName)
 	if err != nil {
-		return []string{fmt.Sprintf(":%s 403 %s %s :No such channel", ph.stateManager.ServerName, user.Nickname, channelName)}, nil
+		return nil, errNoSuchChannel(channelName)
 	}
 
-	if !channel.Operators[user.Nickname] {
-		return []string{fmt.Sprintf(":%s 482 %s %s :You're not channel operator", ph.stateManager.ServerName, user.Nickname, channelName)}, nil
+	if !channel.IsAtLeast(user.ID, models.PrivilegeHalfOp) {
+		return nil, errChanOPrivsNeeded(channelName)
 	}
 
-	channel.BanList = append(channel.BanList, targetMask)
+	channel.AddBan(targetMask)
 	banMsg := fmt.Sprintf(":%s!%s@%s MODE %s +b %s", user.Nickname, user.Username, user.Host, channelName, targetMask)
 	ph.stateManager.ChannelManager.BroadcastToChannel(channel, &models.Message{
 		Sender:  user,
 		Content: banMsg,
 		Type:    models.ServerMessage,
-	}, nil)
+	}, ph.session)
 
 	log.Printf("User %s banned %s from channel %s", user.Nickname, targetMask, channelName)
 
@@ -311,195 +721,429 @@ func (ph *ProtocolHandler) handleNickCommand(params []string) ([]string, error)
 		return nil, fmt.Errorf("ProtocolHandler or its components are nil")
 	}
 	if len(params) < 1 {
-		return []string{fmt.Sprintf(":%s %d * :No nickname given", ph.stateManager.ServerName, ERR_NONICKNAMEGIVEN)}, nil
+		return nil, errNoNicknameGiven()
 	}
 	newNick := params[0]
 
 	// Check if the new nickname is valid
-	if !isValidNickname(newNick) {
-		return []string{fmt.Sprintf(":%s %d * %s :Erroneous nickname", ph.stateManager.ServerName, ERR_ERRONEUSNICKNAME, newNick)}, nil
+	if !isValidNickname(newNick, ph.stateManager.Config.NickPolicy, ph.stateManager.Config.NickLength) {
+		return nil, errErroneusNickname(newNick, "Erroneous nickname")
+	}
+	if serviceFor(newNick) != "" {
+		return nil, errErroneusNickname(newNick, "Reserved for services")
+	}
+	if reason := ph.stateManager.ReservedNicks.Match(newNick); reason != "" {
+		return nil, errErroneusNickname(newNick, reason)
+	}
+
+	if !ph.IsRegistered() {
+		// The user is created once registration completes, where a nickname
+		// in use is checked again since a persistent user may be reattached
+		ph.registration.nickname = newNick
+		return ph.tryRegister()
 	}
 
 	// Check if the nickname is already in use
 	existingUser, _ := ph.stateManager.UserManager.GetUser(newNick)
-	if existingUser != nil {
-		if ph.user == nil || existingUser != ph.user {
-			return []string{fmt.Sprintf(":%s %d * %s :Nickname is already in use", ph.stateManager.ServerName, ERR_NICKNAMEINUSE, newNick)}, nil
-		}
+	if existingUser != nil && existingUser != ph.user {
+		return nil, errNicknameInUse(newNick)
 	}
 
-	if ph.user == nil {
-		// Create a new user if it doesn't exist
-		newUser := models.NewUser(newNick, "", "", "")
-		if err := ph.stateManager.UserManager.AddUser(newUser); err != nil {
-			log.Printf("Failed to add new user: %v", err)
-			return nil, fmt.Errorf("failed to add new user: %w", err)
-		}
-		ph.user = newUser
-		log.Printf("Created new user with nickname %s", newNick)
-		return []string{fmt.Sprintf(":%s NICK %s", newNick, newNick)}, nil
-	} else {
-		oldNick := ph.user.Nickname
-		if oldNick == newNick {
-			// No change in nickname
-			return nil, nil
-		}
-		log.Printf("Changing nickname for user %s to %s", oldNick, newNick)
-		if err := ph.stateManager.UserManager.ChangeNickname(oldNick, newNick); err != nil {
-			log.Printf("Failed to change nickname: %v", err)
-			return nil, fmt.Errorf("failed to change nickname: %w", err)
-		}
-		ph.user.Nickname = newNick
+	oldNick := ph.user.Nickname
+	if oldNick == newNick {
+		// No change in nickname
+		return nil, nil
+	}
+	log.Printf("Changing nickname for user %s to %s", oldNick, newNick)
+	ph.stateManager.Whowas.Record(ph.user)
+	if err := ph.stateManager.UserManager.ChangeNickname(oldNick, newNick); err != nil {
+		log.Printf("Failed to change nickname: %v", err)
+		return nil, fmt.Errorf("failed to change nickname: %w", err)
+	}
+	ph.user.Nickname = newNick
+	ph.stateManager.MessageStore.RenameTarget(oldNick, newNick)
+	if !models.NamesEqual(oldNick, newNick) {
+		ph.stateManager.Monitor.NotifyOffline(oldNick)
+		ph.stateManager.Monitor.NotifyOnline(ph.user)
+	}
 
-		// Notify all channels the user is in about the nickname change
-		nickChangeMsg := fmt.Sprintf(":%s!%s@%s NICK :%s", oldNick, ph.user.Username, ph.user.Host, newNick)
-		serverMsg := &models.Message{
-			Sender:  ph.user,
-			Content: nickChangeMsg,
-			Type:    models.ServerMessage,
-		}
-		for _, channelName := range ph.user.Channels {
-			channel, err := ph.stateManager.ChannelManager.GetChannel(channelName)
-			if err != nil {
-				log.Printf("Failed to get channel %s: %v", channelName, err)
-				continue
-			}
-			ph.stateManager.ChannelManager.BroadcastToChannel(channel, serverMsg, ph.user)
-		}
+	// Notify the user's other sessions and everyone sharing a channel with
+	// them about the nickname change, once each
+	nickChangeMsg := fmt.Sprintf(":%s!%s@%s NICK :%s", oldNick, ph.user.Username, ph.user.Host, newNick)
+	ph.stateManager.ChannelManager.SendToNeighbors(ph.user, func(session models.ClientSession) string {
+		return models.TagAccount(nickChangeMsg, ph.user, session)
+	}, ph.session)
 
-		// Send the nickname change message to the user who changed their nickname
-		return []string{nickChangeMsg}, nil
-	}
+	// Send the nickname change message to the session that changed it
+	return []string{models.TagAccount(nickChangeMsg, ph.user, ph.session)}, nil
 }
 
-func isValidNickname(nickname string) bool {
-	// Implement nickname validation logic here
-	// For example, you can use a regular expression to check if the nickname is valid
-	// This is a simple example, you may want to adjust it based on your specific requirements
-	match, _ := regexp.MatchString("^[a-zA-Z][a-zA-Z0-9_-]{0,8}$", nickname)
-	return match
+// channelTypes are the prefixes of channel names (CHANTYPES). Channels
+// starting with & are local to the server, which with a single server makes
+// them behave like # channels.
+const channelTypes = "#&"
+
+// isChannelName reports whether a target names a channel rather than a user
+func isChannelName(name string) bool {
+	return name != "" && strings.IndexByte(channelTypes, name[0]) >= 0
 }
 
-func (ph *ProtocolHandler) handleUserCommand(params []string) ([]string, error) {
-	if len(params) < 4 {
-		return nil, fmt.Errorf("not enough parameters for USER command")
-	}
-	username, _, _, realname := params[0], params[1], params[2], params[3]
+// isValidChannelName checks a channel name against the length limit and the
+// characters RFC 2812 forbids: space, comma, colon, BEL, NUL, CR and LF.
+// Names that read as a membership prefix followed by a channel name, such as
+// &#chan or &&chan since & is both the admin prefix and a channel type, are
+// refused so that clients stripping the PREFIX characters in front of a
+// channel name in RPL_WHOISCHANNELS or NAMES read channels unambiguously.
+func isValidChannelName(name string, maxLength int) bool {
+	return isChannelName(name) && len(name) > 1 && len(name) <= maxLength &&
+		!strings.ContainsAny(name, " ,:\x00\x07\r\n") &&
+		!(strings.IndexByte(models.MembershipPrefixes(), name[0]) >= 0 && isChannelName(name[1:]))
+}
 
-	if ph.user == nil {
-		return nil, fmt.Errorf("user not initialized")
+// isValidNickname checks a nickname against the length limit and the
+// configured policy:
+//   - rfc2812: a letter or one of []\`_^{|} followed by those, digits or -
+//   - strict: a letter followed by letters, digits, _ or -
+//   - relaxed: any printable UTF-8 except space and ,*?!@.: and not starting
+//     with a digit, -, $ or a channel prefix
+func isValidNickname(nickname, policy string, maxLength int) bool {
+	if nickname == "" || len(nickname) > maxLength {
+		return false
 	}
 
-	log.Printf("Setting user information for %s: username=%s, realname=%s", ph.user.Nickname, username, realname)
-
-	ph.user.Username = username
-	ph.user.Realname = realname
-	ph.user.Host = "localhost" // Set a default host
+	if policy == "relaxed" {
+		if !utf8.ValidString(nickname) || strings.ContainsAny(nickname, " ,*?!@.:") ||
+			strings.ContainsAny(nickname[:1], "-$0123456789"+channelTypes) {
+			return false
+		}
+		for _, r := range nickname {
+			if !unicode.IsPrint(r) {
+				return false
+			}
+		}
+		return true
+	}
 
-	if err := ph.stateManager.UserManager.UpdateUser(ph.user); err != nil {
-		log.Printf("Failed to update user: %v", err)
-		return nil, fmt.Errorf("failed to update user: %w", err)
+	for i := 0; i < len(nickname); i++ {
+		c := nickname[i]
+		letter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		digit := c >= '0' && c <= '9'
+		switch {
+		case letter:
+		case policy == "strict":
+			if i == 0 || !(digit || c == '_' || c == '-') {
+				return false
+			}
+		case strings.IndexByte("[]\\`_^{|}", c) >= 0:
+		case i == 0 || !(digit || c == '-'):
+			return false
+		}
 	}
+	return true
+}
 
-	welcomeMsg := []string{
-		fmt.Sprintf(":%s 001 %s :Welcome to the Gossip IRC Network %s!%s@%s",
-			ph.stateManager.ServerName, ph.user.Nickname, ph.user.Nickname, ph.user.Username, ph.user.Host),
-		fmt.Sprintf(":%s 002 %s :Your host is %s, running version 1.0",
-			ph.stateManager.ServerName, ph.user.Nickname, ph.stateManager.ServerName),
-		fmt.Sprintf(":%s 003 %s :This server was created %s",
-			ph.stateManager.ServerName, ph.user.Nickname, time.Now().Format(time.RFC1123)),
-		fmt.Sprintf(":%s 004 %s %s 1.0 o o",
-			ph.stateManager.ServerName, ph.user.Nickname, ph.stateManager.ServerName),
+func (ph *ProtocolHandler) handleUserCommand(params []string) ([]string, error) {
+	if ph.IsRegistered() {
+		return nil, errAlreadyRegistered()
+	}
+	if len(params) < 4 {
+		return nil, errNeedMoreParams("USER")
 	}
-	return welcomeMsg, nil
+
+	ph.registration.username = params[0]
+	ph.registration.realname = truncate(params[3], ph.stateManager.Config.NameLength)
+	return ph.tryRegister()
 }
 
 func (ph *ProtocolHandler) handleJoinCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 1 {
-		return nil, fmt.Errorf("not enough parameters for JOIN command")
+		return nil, errNeedMoreParams("JOIN")
 	}
-	channelName := params[0]
-	key := ""
+	if params[0] == "0" {
+		return ph.partAll(user)
+	}
+
+	// JOIN #a,#b keyA,keyB pairs each channel with the key at the same position
+	var keys []string
 	if len(params) > 1 {
-		key = params[1]
+		keys = strings.Split(params[1], ",")
 	}
+	var replies []string
+	for i, channelName := range strings.Split(params[0], ",") {
+		if channelName == "" {
+			continue
+		}
+		key := ""
+		if i < len(keys) {
+			key = keys[i]
+		}
+		reply, err := ph.joinChannel(user, channelName, key)
+		if replies, err = ph.reportError(append(replies, reply...), err); err != nil {
+			log.Printf("Failed to join channel %s: %v", channelName, err)
+		}
+	}
+	return replies, nil
+}
 
+// joinChannel joins a single channel, creating it if needed, and returns the
+// JOIN, topic and names for the session that sent the command
+func (ph *ProtocolHandler) joinChannel(user *models.User, channelName, key string) ([]string, error) {
 	log.Printf("User %s is joining channel %s", user.Nickname, channelName)
 
+	if !isChannelName(channelName) {
+		return nil, errNoSuchChannel(channelName)
+	}
+	if !isValidChannelName(channelName, ph.stateManager.Config.ChannelLength) {
+		return nil, errBadChanName(channelName)
+	}
+	if !user.IsInChannel(channelName) && len(user.Channels) >= ph.stateManager.Config.MaxChannels {
+		return nil, errTooManyChannels(channelName)
+	}
+
 	_, err := ph.stateManager.ChannelManager.GetChannel(channelName)
 	if err != nil {
 		log.Printf("Channel %s not found, creating new channel", channelName)
 		_, err = ph.stateManager.ChannelManager.CreateChannel(channelName, user)
 		if err != nil {
-			log.Printf("Failed to create channel %s: %v", channelName, err)
 			return nil, fmt.Errorf("failed to create channel: %w", err)
 		}
 	}
 
-	if err := ph.stateManager.ChannelManager.JoinChannel(user, channelName, key); err != nil {
-		log.Printf("Failed to join channel %s: %v", channelName, err)
-		if err.Error() == "cannot join channel: incorrect key" {
-			return []string{fmt.Sprintf(":%s 475 %s %s :Cannot join channel (+k) - bad key", ph.stateManager.ServerName, user.Nickname, channelName)}, nil
+	// JoinChannel tells the members and the user's other sessions
+	replies, err := ph.stateManager.ChannelManager.JoinChannel(user, channelName, key, ph.session)
+	if err != nil {
+		switch err {
+		case state.ErrBadChannelKey:
+			return nil, errBadChannelKey(channelName)
+		case state.ErrBannedFromChannel:
+			return nil, errBannedFromChan(channelName)
+		case state.ErrInviteOnlyChannel:
+			return nil, errInviteOnlyChan(channelName)
 		}
 		return nil, fmt.Errorf("failed to join channel: %w", err)
 	}
-
-	// The JoinChannel function now handles sending all necessary messages
-	return nil, nil
+	return replies, nil
 }
 
 func (ph *ProtocolHandler) handlePartCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 1 {
-		return nil, fmt.Errorf("not enough parameters for PART command")
+		return nil, errNeedMoreParams("PART")
 	}
-	channelName := params[0]
+	reason := ""
+	if len(params) > 1 {
+		reason = params[1]
+	}
+
+	var replies []string
+	for _, channelName := range strings.Split(params[0], ",") {
+		if channelName == "" {
+			continue
+		}
+		reply, err := ph.partChannel(user, channelName, reason)
+		if replies, err = ph.reportError(append(replies, reply...), err); err != nil {
+			log.Printf("Failed to leave channel %s: %v", channelName, err)
+		}
+	}
+	return replies, nil
+}
 
+// partAll handles JOIN 0 by leaving every channel the user is in
+func (ph *ProtocolHandler) partAll(user *models.User) ([]string, error) {
+	channels := append([]string(nil), user.Channels...)
+	var replies []string
+	for _, channelName := range channels {
+		reply, err := ph.partChannel(user, channelName, "")
+		if err != nil {
+			log.Printf("Failed to leave channel %s: %v", channelName, err)
+		}
+		replies = append(replies, reply...)
+	}
+	return replies, nil
+}
+
+// partChannel removes the user from a channel after telling every member,
+// including the user's other sessions, and returns the PART for the session
+// that sent the command
+func (ph *ProtocolHandler) partChannel(user *models.User, channelName, reason string) ([]string, error) {
 	log.Printf("User %s is leaving channel %s", user.Nickname, channelName)
 
-	if err := ph.stateManager.ChannelManager.LeaveChannel(user, channelName); err != nil {
-		log.Printf("Failed to leave channel %s: %v", channelName, err)
-		return nil, fmt.Errorf("failed to leave channel: %w", err)
+	channel, err := ph.stateManager.ChannelManager.GetChannel(channelName)
+	if err != nil {
+		return nil, errNoSuchChannel(channelName)
+	}
+	if !channel.HasMember(user.ID) {
+		return nil, errNotOnChannel(channel.Name)
 	}
 
-	partMsg := []string{fmt.Sprintf(":%s!%s@%s PART %s", user.Nickname, user.Username, user.Host, channelName)}
-	return partMsg, nil
+	partMsg := fmt.Sprintf(":%s PART %s", user.Hostmask(), channel.Name)
+	if reason != "" {
+		partMsg += " :" + reason
+	}
+	ph.stateManager.ChannelManager.BroadcastToChannel(channel, &models.Message{
+		Sender:  user,
+		Content: partMsg,
+		Type:    models.ServerMessage,
+	}, ph.session)
+
+	if err := ph.stateManager.ChannelManager.LeaveChannel(user, channel.Name); err == state.ErrNotOnChannel {
+		return nil, errNotOnChannel(channel.Name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to leave channel: %w", err)
+	}
+	return []string{partMsg}, nil
 }
 
 func (ph *ProtocolHandler) handlePrivmsgCommand(user *models.User, params []string) ([]string, error) {
-	if len(params) < 2 {
-		return nil, fmt.Errorf("not enough parameters for PRIVMSG command")
+	if len(params) < 1 || params[0] == "" {
+		return nil, errNoRecipient("PRIVMSG")
+	}
+	if len(params) < 2 || params[1] == "" {
+		return nil, errNoTextToSend()
+	}
+	targets, message := strings.Split(params[0], ","), params[1]
+	if len(targets) > ph.stateManager.Config.MaxTargets {
+		return nil, errTooManyTargets(params[0])
 	}
-	target, message := params[0], params[1]
 
-	// Remove the leading colon from the message
-	if strings.HasPrefix(message, ":") {
-		message = message[1:]
+	var replies []string
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		reply, err := ph.privmsgTarget(user, target, message)
+		if replies, err = ph.reportError(append(replies, reply...), err); err != nil {
+			log.Printf("Failed to send a message to %s: %v", target, err)
+		}
+	}
+	return replies, nil
+}
+
+// privmsgTarget delivers a PRIVMSG to a single channel, user or service
+func (ph *ProtocolHandler) privmsgTarget(user *models.User, target, message string) ([]string, error) {
+	// Messages to the services carry passwords and are never logged
+	if service := serviceFor(target); service != "" {
+		replies, err := ph.handleServiceMessage(user, service, message)
+		echoed := ph.echo(user, []string{models.NewMessage(user, service, message, models.PrivateMessage).IRCLine()})
+		replies = append(echoed, replies...)
+		return replies, err
 	}
 
 	log.Printf("User %s is sending a message to %s: %s", user.Nickname, target, message)
 
-	if strings.HasPrefix(target, "#") {
+	if isChannelName(target) {
 		channel, err := ph.stateManager.ChannelManager.GetChannel(target)
 		if err != nil {
-			log.Printf("Channel %s not found", target)
-			return nil, fmt.Errorf("channel not found: %s", target)
+			return nil, errNoSuchChannel(target)
 		}
-		msg := models.NewMessage(user, target, message, models.ChannelMessage)
-		ph.stateManager.MessageStore.StoreMessage(msg)
-		ph.stateManager.ChannelManager.BroadcastToChannel(channel, msg, user)
+		if !canSendToChannel(user, channel) {
+			return nil, errCannotSendToChan(channel.Name)
+		}
+		return ph.deliverToChannel(user, channel, message, models.ChannelMessage), nil
 	} else {
 		targetUser, err := ph.stateManager.UserManager.GetUser(target)
 		if err != nil {
-			log.Printf("User %s not found", target)
-			return nil, fmt.Errorf("user not found: %s", target)
+			return nil, errNoSuchNick(target)
+		}
+		replies := ph.deliverToUser(user, targetUser, message, models.PrivateMessage)
+		if targetUser.Modes.Away {
+			replies = append(replies, fmt.Sprintf(":%s 301 %s %s :%s", ph.stateManager.ServerName, user.Nickname, targetUser.Nickname, targetUser.AwayMessage))
 		}
-		msg := models.NewMessage(user, target, message, models.PrivateMessage)
+		return replies, nil
+	}
+}
+
+// handleNoticeCommand delivers a NOTICE. Per RFC 2812 no automatic reply,
+// including error replies, is ever sent in response to a NOTICE.
+func (ph *ProtocolHandler) handleNoticeCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 2 {
+		return nil, nil
+	}
+	targets, message := strings.Split(params[0], ","), params[1]
+	if len(targets) > ph.stateManager.Config.MaxTargets {
+		return nil, nil
+	}
+
+	var replies []string
+	for _, target := range targets {
+		if target == "" || serviceFor(target) != "" {
+			continue
+		}
+		log.Printf("User %s is sending a notice to %s: %s", user.Nickname, target, message)
+
+		if isChannelName(target) {
+			if channel, err := ph.stateManager.ChannelManager.GetChannel(target); err == nil && canSendToChannel(user, channel) {
+				replies = append(replies, ph.deliverToChannel(user, channel, message, models.Notice)...)
+			}
+		} else if targetUser, err := ph.stateManager.UserManager.GetUser(target); err == nil {
+			replies = append(replies, ph.deliverToUser(user, targetUser, message, models.Notice)...)
+		}
+	}
+
+	return replies, nil
+}
+
+// canSendToChannel enforces the no external messages (+n) and moderated (+m)
+// channel modes
+func canSendToChannel(user *models.User, channel *models.Channel) bool {
+	if channel.Modes.NoExternal && !channel.HasMember(user.ID) {
+		return false
+	}
+	return !channel.Modes.Moderated || channel.IsAtLeast(user.ID, models.PrivilegeVoice)
+}
+
+// deliverToChannel stores a PRIVMSG or NOTICE in the channel history and
+// relays it to the members and the sender's other sessions, split into lines
+// that fit the limit. It returns the lines to echo to the sending session.
+func (ph *ProtocolHandler) deliverToChannel(user *models.User, channel *models.Channel, text string, msgType models.MessageType) []string {
+	user.UpdateLastSeen()
+	var echoed []string
+	for _, msg := range models.NewMessage(user, channel.Name, text, msgType).Split() {
 		ph.stateManager.MessageStore.StoreMessage(msg)
-		formattedMsg := fmt.Sprintf(":%s!%s@%s PRIVMSG %s :%s", user.Nickname, user.Username, user.Host, target, message)
-		targetUser.BroadcastToSessions(formattedMsg)
+		ph.stateManager.ChannelManager.BroadcastToChannel(channel, msg, ph.session)
+		echoed = append(echoed, msg.IRCLine())
 	}
+	return ph.echo(user, echoed)
+}
 
-	return nil, nil
+// deliverToUser stores a private PRIVMSG or NOTICE and relays it to every
+// session of the target user and the sender's other sessions, split into
+// lines that fit the limit. It returns the lines to echo to the sending
+// session.
+func (ph *ProtocolHandler) deliverToUser(user *models.User, target *models.User, text string, msgType models.MessageType) []string {
+	user.UpdateLastSeen()
+	// A session messaging its own user gets the message as a recipient
+	// unless it is echoed anyway
+	exclude := ph.session
+	if target == user && !ph.HasCapability("echo-message") {
+		exclude = nil
+	}
+	var echoed []string
+	for _, msg := range models.NewMessage(user, target.Nickname, text, msgType).Split() {
+		ph.stateManager.MessageStore.StoreMessage(msg)
+		line := msg.IRCLine()
+		render := func(session models.ClientSession) string {
+			return models.TagAccount(line, user, session)
+		}
+		target.SendToOtherSessions(render, exclude)
+		if target != user {
+			user.SendToOtherSessions(render, ph.session)
+		}
+		echoed = append(echoed, line)
+	}
+	return ph.echo(user, echoed)
+}
+
+// echo returns the messages a session sent when it negotiated echo-message,
+// so that it sees them as the other recipients do
+func (ph *ProtocolHandler) echo(user *models.User, lines []string) []string {
+	if !ph.HasCapability("echo-message") {
+		return nil
+	}
+	echoed := make([]string, len(lines))
+	for i, line := range lines {
+		echoed[i] = models.TagAccount(line, user, ph.session)
+	}
+	return echoed
 }
 
 func (ph *ProtocolHandler) handleQuitCommand(user *models.User, params []string) ([]string, error) {
@@ -508,36 +1152,118 @@ func (ph *ProtocolHandler) handleQuitCommand(user *models.User, params []string)
 		quitMessage = params[0]
 	}
 
+	ph.closeReason = "Quit: " + quitMessage
+	if user == nil {
+		return nil, nil
+	}
+
 	log.Printf("User %s is quitting: %s", user.Nickname, quitMessage)
 
-	// Dont' remove user from all channels
-	//for _, channelName := range user.Channels {
-	//	ph.stateManager.ChannelManager.LeaveChannel(user, channelName)
-	// }
+	// Tell everyone sharing a channel with the user once, then leave the
+	// channels, which are deleted once empty
+	quitMsg := fmt.Sprintf(":%s QUIT :%s", user.Hostmask(), quitMessage)
+	ph.stateManager.ChannelManager.SendToNeighbors(user, func(session models.ClientSession) string {
+		return models.TagAccount(quitMsg, user, session)
+	}, ph.session)
+	for _, channelName := range append([]string(nil), user.Channels...) {
+		if err := ph.stateManager.ChannelManager.LeaveChannel(user, channelName); err != nil {
+			log.Printf("Failed to remove %s from %s: %v", user.Nickname, channelName, err)
+		}
+	}
 
 	// Remove user from UserManager
+	ph.stateManager.Whowas.Record(user)
 	ph.stateManager.UserManager.RemoveUser(user.Nickname)
+	ph.stateManager.Monitor.Clear(user)
+	ph.stateManager.Monitor.NotifyOffline(user.Nickname)
 
-	quitMsg := []string{fmt.Sprintf(":%s!%s@%s QUIT :%s", user.Nickname, user.Username, user.Host, quitMessage)}
-	return quitMsg, nil
+	return []string{quitMsg}, nil
 }
 
 func (ph *ProtocolHandler) handleCapCommand(user *models.User, params []string) ([]string, error) {
 	if len(params) < 1 {
-		return nil, fmt.Errorf("not enough parameters for CAP command")
+		return nil, errNeedMoreParams("CAP")
 	}
 
-	subCommand := params[0]
+	subCommand := strings.ToUpper(params[0])
 	log.Printf("Handling CAP command for user: %s", subCommand)
 
+	nickname := ph.clientName()
+
+	// Registration is suspended while capabilities are negotiated
+	if !ph.IsRegistered() && (subCommand == "LS" || subCommand == "REQ") {
+		ph.registration.capNegotiating = true
+	}
+
 	switch subCommand {
 	case "LS":
-		return []string{"CAP * LS :"}, nil
+		version := 0
+		if len(params) > 1 {
+			version, _ = strconv.Atoi(params[1])
+		}
+		capabilities := make([]string, 0, len(supportedCapabilities))
+		for _, name := range supportedCapabilities {
+			if value, ok := capabilityValues[name]; ok && version >= 302 {
+				name += "=" + value
+			}
+			capabilities = append(capabilities, name)
+		}
+		return []string{fmt.Sprintf(":%s CAP %s LS :%s", ph.stateManager.ServerName, nickname, strings.Join(capabilities, " "))}, nil
+	case "LIST":
+		ph.capMutex.RLock()
+		enabled := make([]string, 0, len(ph.capabilities))
+		for name := range ph.capabilities {
+			enabled = append(enabled, name)
+		}
+		ph.capMutex.RUnlock()
+		sort.Strings(enabled)
+		return []string{fmt.Sprintf(":%s CAP %s LIST :%s", ph.stateManager.ServerName, nickname, strings.Join(enabled, " "))}, nil
 	case "REQ":
-		return []string{"CAP * ACK :"}, nil
+		requested := ""
+		if len(params) > 1 {
+			requested = params[1]
+		}
+		if !ph.requestCapabilities(strings.Fields(requested)) {
+			return []string{fmt.Sprintf(":%s CAP %s NAK :%s", ph.stateManager.ServerName, nickname, requested)}, nil
+		}
+		return []string{fmt.Sprintf(":%s CAP %s ACK :%s", ph.stateManager.ServerName, nickname, requested)}, nil
 	case "END":
-		return nil, nil
+		if ph.IsRegistered() {
+			return nil, nil
+		}
+		ph.registration.capNegotiating = false
+		return ph.tryRegister()
 	default:
-		return nil, fmt.Errorf("unknown CAP subcommand: %s", subCommand)
+		return nil, errInvalidCapCmd(subCommand)
+	}
+}
+
+// requestCapabilities applies a CAP REQ atomically: either every requested
+// change is supported and applied, or none is
+func (ph *ProtocolHandler) requestCapabilities(requested []string) bool {
+	for _, name := range requested {
+		if !isSupportedCapability(strings.TrimPrefix(name, "-")) {
+			return false
+		}
+	}
+
+	ph.capMutex.Lock()
+	defer ph.capMutex.Unlock()
+	for _, name := range requested {
+		if strings.HasPrefix(name, "-") {
+			delete(ph.capabilities, name[1:])
+		} else {
+			ph.capabilities[name] = true
+		}
+	}
+	return true
+}
+
+func isSupportedCapability(name string) bool {
+	for _, supported := range supportedCapabilities {
+		if supported == name {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,464 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/exogmi/gossip/config"
+	"github.com/exogmi/gossip/internal/models"
+	"github.com/exogmi/gossip/internal/state"
+)
+
+func TestChannelNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"#chan", true},
+		{"&local", true},
+		{"&&chan", false},
+		{"&#chan", false},
+		{"#&chan", true},
+		{"##chan", true},
+		{"#", false},
+		{"&", false},
+		{"chan", false},
+		{"&a,b", false},
+		{"&a b", false},
+		{"&a:b", false},
+		{"&a\x07", false},
+		{"&" + strings.Repeat("a", 50), false},
+	}
+	for _, tt := range tests {
+		if got := isValidChannelName(tt.name, 50); got != tt.valid {
+			t.Errorf("isValidChannelName(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+
+	// & is both the admin prefix and a channel type, which is unambiguous
+	// since no channel name starts with a prefix followed by a channel name
+	client := newTestClient(t, newTestState(t, nil))
+	client.register("alice")
+	if lines := client.send("JOIN &&chan"); !hasReply(lines, "479") {
+		t.Errorf("JOIN &&chan got %q, want 479", lines)
+	}
+	if lines := client.send("JOIN &chan"); !strings.HasSuffix(findReply(lines, "353"), " &chan :@alice") {
+		t.Errorf("JOIN &chan got %q", lines)
+	}
+	if lines := client.send("WHOIS alice"); !strings.HasSuffix(findReply(lines, "319"), " alice :@&chan") {
+		t.Errorf("WHOIS got %q, want @&chan", lines)
+	}
+	if !strings.Contains(models.PrefixISupport(), "&") {
+		t.Errorf("PREFIX %s does not use & for admins", models.PrefixISupport())
+	}
+}
+
+func TestMyInfoModes(t *testing.T) {
+	// Every membership mode takes a nickname parameter
+	for _, mode := range "qaohv" {
+		if !strings.ContainsRune(channelModes, mode) || !strings.ContainsRune(channelModesWithParam, mode) {
+			t.Errorf("Channel mode %c is missing from RPL_MYINFO", mode)
+		}
+	}
+}
+
+// fakeSession is a client session recording the lines sent to it
+type fakeSession struct {
+	handler *ProtocolHandler
+	lines   []string
+	mu      sync.Mutex
+}
+
+func (fs *fakeSession) SendMessage(message string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lines = append(fs.lines, message)
+	return nil
+}
+
+func (fs *fakeSession) SendBatch(batch *models.Batch) error {
+	for _, line := range batch.Lines(fs.HasCapability("batch")) {
+		fs.SendMessage(line)
+	}
+	return nil
+}
+
+func (fs *fakeSession) HasCapability(name string) bool {
+	return fs.handler.HasCapability(name)
+}
+
+func (fs *fakeSession) IsSecure() bool {
+	return false
+}
+
+// take returns the lines sent to the session since the last call
+func (fs *fakeSession) take() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	lines := fs.lines
+	fs.lines = nil
+	return lines
+}
+
+// testClient drives a protocol handler the way a client connection does
+type testClient struct {
+	t        *testing.T
+	handler  *ProtocolHandler
+	session  *fakeSession
+	attached bool
+}
+
+func newTestState(t *testing.T, configure func(cfg *config.Config)) *state.StateManager {
+	cfg := &config.Config{
+		ServerName:            "irc.test",
+		NetworkName:           "Test",
+		Casemapping:           "rfc1459",
+		NickPolicy:            "rfc2812",
+		NickLength:            30,
+		ChannelLength:         50,
+		TopicLength:           390,
+		KickLength:            255,
+		AwayLength:            200,
+		NameLength:            128,
+		MaxChannels:           50,
+		MonitorLimit:          100,
+		MaxTargets:            4,
+		MonitorDetachedOnline: true,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	return state.NewStateManager(state.NewUserManager(), state.NewMessageStore(100), cfg)
+}
+
+func newTestClient(t *testing.T, stateManager *state.StateManager) *testClient {
+	handler := NewProtocolHandler(stateManager)
+	session := &fakeSession{handler: handler}
+	handler.SetSession(session)
+	return &testClient{t: t, handler: handler, session: session}
+}
+
+// send handles a line from the client and returns every line sent back to
+// it since the previous line
+func (tc *testClient) send(line string) []string {
+	tc.t.Helper()
+	message, err := NewProtocolParser().Parse(line)
+	if err != nil {
+		tc.t.Fatalf("Parse(%q) error = %v", line, err)
+	}
+	replies, err := tc.handler.HandleCommand(tc.handler.GetUser(), message)
+	if err != nil {
+		tc.t.Fatalf("HandleCommand(%q) error = %v", line, err)
+	}
+	for _, reply := range replies {
+		tc.session.SendMessage(reply)
+	}
+	if user := tc.handler.GetUser(); user != nil && !tc.attached {
+		user.AddClientSession(fmt.Sprintf("%p", tc.session), tc.session)
+		tc.attached = true
+	}
+	return tc.session.take()
+}
+
+// register completes registration with the given nickname
+func (tc *testClient) register(nickname string) []string {
+	tc.t.Helper()
+	tc.send("NICK " + nickname)
+	return tc.send("USER " + nickname + " 0 * :" + nickname)
+}
+
+// hasReply reports whether one of the lines is the given numeric or command
+// sent by the server
+func hasReply(lines []string, command string) bool {
+	return findReply(lines, command) != ""
+}
+
+// findReply returns the first line carrying the given numeric or command
+func findReply(lines []string, command string) string {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && strings.HasPrefix(fields[0], ":") {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && fields[0] == command {
+			return line
+		}
+	}
+	return ""
+}
+
+func TestMultiTargetCommands(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+
+	bob.send("JOIN #locked")
+	bob.send("MODE #locked +k sesame")
+	bob.session.take()
+
+	lines := alice.send("JOIN #open,#locked,#other nope")
+	if joined := strings.Count(strings.Join(lines, "\n"), "JOIN "); joined != 2 {
+		t.Errorf("JOIN with one key got %d JOINs in %q, want 2", joined, lines)
+	}
+	if !hasReply(lines, "475") {
+		t.Errorf("JOIN with a wrong key got %q, want 475", lines)
+	}
+	if lines := alice.send("JOIN #locked,#open sesame"); !hasReply(lines, "JOIN") {
+		t.Errorf("JOIN with the key got %q", lines)
+	}
+
+	lines = alice.send("PART #open,#missing,#locked :see you")
+	if parts := strings.Count(strings.Join(lines, "\n"), " PART #"); parts != 2 || !strings.Contains(lines[0], ":see you") {
+		t.Errorf("PART of two channels got %q, want 2 PARTs with the reason", lines)
+	}
+	if !hasReply(lines, "403") && !hasReply(lines, "442") {
+		t.Errorf("PART of an unknown channel got %q, want an error", lines)
+	}
+	if got := bob.session.take(); len(got) != 2 || !strings.HasSuffix(got[1], "PART #locked :see you") {
+		t.Errorf("Channel members got %q, want the JOIN and PART of alice", got)
+	}
+
+	lines = alice.send("PRIVMSG bob,nobody,#locked :hi")
+	if len(lines) != 1 || !hasReply(lines, "401") {
+		t.Errorf("PRIVMSG to a missing target got %q, want 401", lines)
+	}
+	got := bob.session.take()
+	if len(got) != 2 || !strings.HasSuffix(got[0], "PRIVMSG bob :hi") || !strings.HasSuffix(got[1], "PRIVMSG #locked :hi") {
+		t.Errorf("PRIVMSG targets got %q", got)
+	}
+}
+
+func TestQuitLeavesChannels(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #chan,#other")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("JOIN #chan,#other,#solo")
+	alice.session.take()
+
+	if lines := bob.send("QUIT :gone"); len(lines) != 1 || lines[0] != ":bob!bob@localhost QUIT :gone" {
+		t.Errorf("QUIT got %q", lines)
+	}
+	if got := alice.session.take(); len(got) != 1 || got[0] != ":bob!bob@localhost QUIT :gone" {
+		t.Errorf("Channel members got %q, want a single QUIT", got)
+	}
+	if _, err := stateManager.GetChannel("#solo"); err == nil {
+		t.Error("The channel left empty by QUIT was not deleted")
+	}
+
+	// A new user of the same nickname does not find a ghost of the old one
+	bob = newTestClient(t, stateManager)
+	bob.register("bob")
+	lines := bob.send("JOIN #chan")
+	if got := findReply(lines, "353"); !strings.HasSuffix(got, " #chan :@alice bob") && !strings.HasSuffix(got, " #chan :bob @alice") {
+		t.Errorf("NAMES after rejoining got %q, want alice and a single bob", got)
+	}
+	if lines := bob.send("JOIN #solo"); !strings.HasSuffix(findReply(lines, "353"), " #solo :@bob") {
+		t.Errorf("Joining a channel left empty by QUIT got %q, want to be its operator", lines)
+	}
+}
+
+func TestTopicVisibility(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #public,#private,#secret")
+	alice.send("MODE #private +p")
+	alice.send("MODE #secret +s")
+	for _, channel := range []string{"#public", "#private", "#secret"} {
+		alice.send("TOPIC " + channel + " :the \"plan\" café")
+	}
+	probe := newTestClient(t, stateManager)
+	probe.register("probe")
+
+	tests := []struct {
+		channel string
+		reply   string
+	}{
+		{"#public", "332"},
+		{"#private", "442"},
+		{"#secret", "403"},
+	}
+	for _, tt := range tests {
+		lines := probe.send("TOPIC " + tt.channel)
+		if !hasReply(lines, tt.reply) {
+			t.Errorf("TOPIC %s from a non-member got %q, want %s", tt.channel, lines, tt.reply)
+		}
+		if tt.reply != "332" && strings.Contains(strings.Join(lines, "\n"), "plan") {
+			t.Errorf("TOPIC %s from a non-member leaked the topic: %q", tt.channel, lines)
+		}
+	}
+	if lines := alice.send("TOPIC #secret"); !strings.HasSuffix(findReply(lines, "332"), " #secret :the \"plan\" café") {
+		t.Errorf("TOPIC #secret from a member got %q", lines)
+	}
+
+	lines := alice.send("TOPICHISTORY #public")
+	if len(lines) < 1 || !strings.HasSuffix(lines[0], ": the \"plan\" café") {
+		t.Errorf("TOPICHISTORY got %q, want the topic as sent", lines)
+	}
+}
+
+func TestChannelBanMode(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #chan")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("JOIN #chan")
+	alice.session.take()
+
+	// A bare b lists the bans
+	if lines := alice.send("MODE #chan b"); len(lines) != 1 || !hasReply(lines, "368") {
+		t.Errorf("MODE b got %q, want an empty ban list", lines)
+	}
+
+	// A mask without a direction is added
+	want := ":alice!alice@localhost MODE #chan +b *!*@evil"
+	if lines := alice.send("MODE #chan b *!*@evil"); len(lines) != 1 || lines[0] != want {
+		t.Errorf("MODE b with a mask got %q, want %q", lines, want)
+	}
+	if got := bob.session.take(); len(got) != 1 || got[0] != want {
+		t.Errorf("Channel members got %q, want %q", got, want)
+	}
+	if lines := bob.send("MODE #chan +b"); !strings.HasSuffix(findReply(lines, "367"), " #chan *!*@evil") {
+		t.Errorf("MODE +b got %q, want the ban listed", lines)
+	}
+
+	// Nothing is announced when the ban list does not change
+	if lines := alice.send("MODE #chan -b *!*@nobody"); len(lines) != 0 {
+		t.Errorf("Removing a missing ban got %q", lines)
+	}
+	if lines := bob.send("MODE #chan -b *!*@evil"); !hasReply(lines, "482") {
+		t.Errorf("MODE -b from a regular member got %q, want 482", lines)
+	}
+}
+
+func TestUTF8OnlyISupport(t *testing.T) {
+	for _, utf8Only := range []bool{false, true} {
+		client := newTestClient(t, newTestState(t, func(cfg *config.Config) { cfg.UTF8Only = utf8Only }))
+		lines := client.register("alice")
+		if got := strings.Contains(strings.Join(lines, "\n"), " UTF8ONLY "); got != utf8Only {
+			t.Errorf("UTF8ONLY advertised = %v with utf8-only %v", got, utf8Only)
+		}
+	}
+}
+
+func TestInvite(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #chan")
+	dave := newTestClient(t, stateManager)
+	dave.register("dave")
+	dave.send("JOIN #chan")
+	alice.send("MODE #chan +i")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	carol := newTestClient(t, stateManager)
+	carol.register("carol")
+	carol.send("CAP REQ :invite-notify")
+	alice.send("INVITE carol #chan")
+	carol.send("JOIN #chan")
+	alice.send("MODE #chan +o carol")
+	carol.session.take()
+	dave.session.take()
+
+	if lines := bob.send("JOIN #chan"); !hasReply(lines, "473") {
+		t.Errorf("JOIN of an invite-only channel got %q, want 473", lines)
+	}
+	if lines := alice.send("INVITE bob #chan"); !strings.HasSuffix(findReply(lines, "341"), " alice bob #chan") {
+		t.Errorf("INVITE got %q, want 341", lines)
+	}
+	want := ":alice!alice@localhost INVITE bob #chan"
+	if got := bob.session.take(); len(got) != 1 || got[0] != want {
+		t.Errorf("The invited user got %q, want %q", got, want)
+	}
+	if got := carol.session.take(); len(got) != 1 || got[0] != want {
+		t.Errorf("An operator with invite-notify got %q, want %q", got, want)
+	}
+	if got := dave.session.take(); len(got) != 0 {
+		t.Errorf("A member without invite-notify got %q", got)
+	}
+	if lines := bob.send("INVITE"); !strings.HasSuffix(findReply(lines, "336"), " bob #chan") || !hasReply(lines, "337") {
+		t.Errorf("INVITE list got %q, want #chan", lines)
+	}
+	if lines := alice.send("INVITE carol #chan"); !hasReply(lines, "443") {
+		t.Errorf("INVITE of a member got %q, want 443", lines)
+	}
+
+	// The invitation is used up by joining
+	if lines := bob.send("JOIN #chan"); !hasReply(lines, "JOIN") {
+		t.Errorf("JOIN after an invitation got %q", lines)
+	}
+	bob.send("PART #chan")
+	if lines := bob.send("JOIN #chan"); !hasReply(lines, "473") {
+		t.Errorf("JOIN with a used invitation got %q, want 473", lines)
+	}
+	if lines := bob.send("INVITE"); len(lines) != 1 || !hasReply(lines, "337") {
+		t.Errorf("INVITE list after joining got %q, want it empty", lines)
+	}
+
+	// Only operators may invite to an invite-only channel
+	if lines := dave.send("INVITE bob #chan"); !hasReply(lines, "482") {
+		t.Errorf("INVITE from a regular member got %q, want 482", lines)
+	}
+}
+
+func TestNicknamePolicy(t *testing.T) {
+	tests := []struct {
+		nickname string
+		policy   string
+		valid    bool
+	}{
+		{"[bot]", "rfc2812", true},
+		{"nick|away", "rfc2812", true},
+		{"a-1_^`{}\\", "rfc2812", true},
+		{"1nick", "rfc2812", false},
+		{"-nick", "rfc2812", false},
+		{"ni ck", "rfc2812", false},
+		{"nick!", "rfc2812", false},
+		{"café", "rfc2812", false},
+		{"nick_1-a", "strict", true},
+		{"[bot]", "strict", false},
+		{"_nick", "strict", false},
+		{"café", "relaxed", true},
+		{"[bot]", "relaxed", true},
+		{"#nick", "relaxed", false},
+		{"0nick", "relaxed", false},
+		{"ni.ck", "relaxed", false},
+		{"ni*ck", "relaxed", false},
+		{"nick\x01", "relaxed", false},
+		{"abcdefghi", "rfc2812", true},
+		{"abcdefghij", "rfc2812", false},
+		{"abcdefghij", "relaxed", false},
+	}
+	for _, tt := range tests {
+		if got := isValidNickname(tt.nickname, tt.policy, 9); got != tt.valid {
+			t.Errorf("isValidNickname(%q, %s) = %v, want %v", tt.nickname, tt.policy, got, tt.valid)
+		}
+	}
+
+	// The configured policy applies to registration and nickname changes
+	stateManager := newTestState(t, func(cfg *config.Config) { cfg.NickPolicy = "relaxed" })
+	client := newTestClient(t, stateManager)
+	if lines := client.register("[bot]"); !hasReply(lines, "001") {
+		t.Fatalf("Registration as [bot] got %q", lines)
+	}
+	if lines := client.send("NICK café"); !strings.HasSuffix(findReply(lines, "NICK"), " NICK :café") {
+		t.Errorf("NICK café with the relaxed policy got %q", lines)
+	}
+	client = newTestClient(t, newTestState(t, func(cfg *config.Config) { cfg.NickPolicy = "strict" }))
+	if lines := client.send("NICK [bot]"); !hasReply(lines, "432") {
+		t.Errorf("NICK [bot] with the strict policy got %q, want 432", lines)
+	}
+}
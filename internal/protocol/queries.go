@@ -0,0 +1,372 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+// whoxFieldOrder is the order WHOX fields are sent in, whatever order they
+// were requested in
+const whoxFieldOrder = "tcuihsnfdlaor"
+
+// whoQuery holds the WHOX field selector of a WHO request. An empty field
+// list means a classic RPL_WHOREPLY (352) is sent.
+type whoQuery struct {
+	fields string
+	token  string
+}
+
+func parseWhoQuery(selector string) whoQuery {
+	if !strings.HasPrefix(selector, "%") {
+		return whoQuery{}
+	}
+	fields, token, _ := strings.Cut(selector[1:], ",")
+	if token == "" {
+		token = "0"
+	}
+	return whoQuery{fields: fields, token: token}
+}
+
+func (ph *ProtocolHandler) handleWhoCommand(user *models.User, params []string) ([]string, error) {
+	mask := "*"
+	if len(params) > 0 && params[0] != "0" {
+		mask = params[0]
+	}
+	query := whoQuery{}
+	if len(params) > 1 {
+		query = parseWhoQuery(params[1])
+	}
+
+	replies := []string{}
+	if isChannelName(mask) {
+		if channel, err := ph.stateManager.GetChannel(mask); err == nil {
+			isMember := channel.HasMember(user.ID)
+			if isMember || !isHiddenChannel(channel) {
+				for _, member := range channel.Members {
+					if isMember || !member.User.Modes.Invisible {
+						replies = append(replies, ph.whoReply(user, member.User, channel, query))
+					}
+				}
+			}
+		}
+	} else if target, err := ph.stateManager.GetUser(mask); err == nil {
+		// An exact nickname is always answered, even for invisible users
+		replies = append(replies, ph.whoReply(user, target, nil, query))
+	} else {
+		for _, target := range ph.stateManager.UserManager.ListUsers() {
+			if ph.canSee(user, target) && matchesWhoMask(mask, target) {
+				replies = append(replies, ph.whoReply(user, target, nil, query))
+			}
+		}
+	}
+
+	return append(replies, fmt.Sprintf(":%s 315 %s %s :End of WHO list", ph.stateManager.ServerName, user.Nickname, mask)), nil
+}
+
+// whoReply formats a RPL_WHOREPLY, or a RPL_WHOSPCRPL (354) for WHOX queries
+func (ph *ProtocolHandler) whoReply(requester, target *models.User, channel *models.Channel, query whoQuery) string {
+	channelName, prefix := "*", ""
+	if channel != nil {
+		channelName = channel.Name
+		if member, ok := channel.GetMember(target.ID); ok {
+			prefix = member.Prefix(ph.HasCapability("multi-prefix"))
+		}
+	}
+
+	flags := "H"
+	if target.Modes.Away {
+		flags = "G"
+	}
+	if target.Modes.Operator {
+		flags += "*"
+	}
+	flags += prefix
+
+	if query.fields == "" {
+		return fmt.Sprintf(":%s 352 %s %s %s %s %s %s %s :0 %s", ph.stateManager.ServerName, requester.Nickname,
+			channelName, target.Username, target.Host, ph.stateManager.ServerName, target.Nickname, flags, target.Realname)
+	}
+
+	account := target.Account
+	if account == "" {
+		account = "0"
+	}
+
+	values := []string{}
+	for _, field := range whoxFieldOrder {
+		if !strings.ContainsRune(query.fields, field) {
+			continue
+		}
+		switch field {
+		case 't':
+			values = append(values, query.token)
+		case 'c':
+			values = append(values, channelName)
+		case 'u':
+			values = append(values, target.Username)
+		case 'i':
+			values = append(values, "255.255.255.255")
+		case 'h':
+			values = append(values, target.Host)
+		case 's':
+			values = append(values, ph.stateManager.ServerName)
+		case 'n':
+			values = append(values, target.Nickname)
+		case 'f':
+			values = append(values, flags)
+		case 'd':
+			values = append(values, "0")
+		case 'l':
+			values = append(values, strconv.Itoa(int(time.Since(target.LastSeen).Seconds())))
+		case 'a':
+			values = append(values, account)
+		case 'o':
+			values = append(values, "n/a")
+		case 'r':
+			values = append(values, ":"+target.Realname)
+		}
+	}
+	return fmt.Sprintf(":%s 354 %s %s", ph.stateManager.ServerName, requester.Nickname, strings.Join(values, " "))
+}
+
+// canSee reports whether target shows up in requester's mask queries:
+// invisible users are only visible to users sharing a channel with them
+func (ph *ProtocolHandler) canSee(requester, target *models.User) bool {
+	if !target.Modes.Invisible || requester == target {
+		return true
+	}
+	for _, channelName := range requester.Channels {
+		if target.IsInChannel(channelName) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHiddenChannel reports whether a channel is hidden from non-members
+func isHiddenChannel(channel *models.Channel) bool {
+	return channel.Modes.Secret || channel.Modes.Private
+}
+
+// matchesWhoMask matches a WHO mask against a user's nickname, username,
+// host, realname and account
+func matchesWhoMask(mask string, user *models.User) bool {
+	for _, field := range []string{user.Nickname, user.Username, user.Host, user.Realname, user.Account} {
+		if field != "" && models.MatchMask(mask, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ph *ProtocolHandler) handleWhoisCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 1 {
+		return nil, errNoNicknameGiven()
+	}
+	// WHOIS <server> <nick> is answered locally as there is a single server
+	nickname := params[len(params)-1]
+
+	target, err := ph.stateManager.GetUser(nickname)
+	if err != nil {
+		return []string{
+			errNoSuchNick(nickname).Reply(ph.stateManager.ServerName, user.Nickname),
+			fmt.Sprintf(":%s 318 %s %s :End of /WHOIS list", ph.stateManager.ServerName, user.Nickname, nickname),
+		}, nil
+	}
+
+	server, nick := ph.stateManager.ServerName, user.Nickname
+	replies := []string{fmt.Sprintf(":%s 311 %s %s %s %s * :%s", server, nick, target.Nickname, target.Username, target.Host, target.Realname)}
+
+	// Secret and private channels are only listed to their members
+	multiPrefix := ph.HasCapability("multi-prefix")
+	channels := []string{}
+	for _, channelName := range target.Channels {
+		channel, err := ph.stateManager.GetChannel(channelName)
+		if err != nil || (isHiddenChannel(channel) && !channel.HasMember(user.ID)) {
+			continue
+		}
+		prefix := ""
+		if member, ok := channel.GetMember(target.ID); ok {
+			prefix = member.Prefix(multiPrefix)
+		}
+		channels = append(channels, prefix+channel.Name)
+	}
+	if len(channels) > 0 {
+		replies = append(replies, fmt.Sprintf(":%s 319 %s %s :%s", server, nick, target.Nickname, strings.Join(channels, " ")))
+	}
+
+	replies = append(replies, fmt.Sprintf(":%s 312 %s %s %s :Gossip IRC Server", server, nick, target.Nickname, server))
+	if target.Modes.Away {
+		replies = append(replies, fmt.Sprintf(":%s 301 %s %s :%s", server, nick, target.Nickname, target.AwayMessage))
+	}
+	if target.IsSecure() {
+		replies = append(replies, fmt.Sprintf(":%s 671 %s %s :is using a secure connection", server, nick, target.Nickname))
+	}
+	if target.Account != "" {
+		replies = append(replies, fmt.Sprintf(":%s 330 %s %s %s :is logged in as", server, nick, target.Nickname, target.Account))
+	}
+	replies = append(replies,
+		fmt.Sprintf(":%s 320 %s %s :is attached through %d session(s)", server, nick, target.Nickname, target.SessionCount()),
+		fmt.Sprintf(":%s 317 %s %s %d %d :seconds idle, signon time", server, nick, target.Nickname,
+			int(time.Since(target.LastSeen).Seconds()), target.CreatedAt.Unix()),
+		fmt.Sprintf(":%s 318 %s %s :End of /WHOIS list", server, nick, target.Nickname),
+	)
+	return replies, nil
+}
+
+func (ph *ProtocolHandler) handleWhowasCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 1 {
+		return nil, errNoNicknameGiven()
+	}
+	nickname := params[0]
+	count := 0
+	if len(params) > 1 {
+		count, _ = strconv.Atoi(params[1])
+	}
+
+	server, nick := ph.stateManager.ServerName, user.Nickname
+	entries := ph.stateManager.Whowas.Lookup(nickname, count)
+	if len(entries) == 0 {
+		return []string{
+			errWasNoSuchNick(nickname).Reply(server, nick),
+			fmt.Sprintf(":%s 369 %s %s :End of WHOWAS", server, nick, nickname),
+		}, nil
+	}
+
+	replies := []string{}
+	for _, entry := range entries {
+		replies = append(replies, fmt.Sprintf(":%s 314 %s %s %s %s * :%s", server, nick, entry.Nickname, entry.Username, entry.Host, entry.Realname))
+		if entry.Account != "" {
+			replies = append(replies, fmt.Sprintf(":%s 330 %s %s %s :was logged in as", server, nick, entry.Nickname, entry.Account))
+		}
+		replies = append(replies, fmt.Sprintf(":%s 312 %s %s %s :%s", server, nick, entry.Nickname, server, entry.Time.Format(time.RFC1123)))
+	}
+	return append(replies, fmt.Sprintf(":%s 369 %s %s :End of WHOWAS", server, nick, nickname)), nil
+}
+
+// listFilter holds the ELIST conditions of a LIST request
+type listFilter struct {
+	masks      []string // Channel names or masks, any of which must match
+	notMasks   []string // Masks none of which may match
+	conditions []func(channel *models.Channel) bool
+}
+
+// parseListFilter parses comma-separated LIST targets and ELIST conditions:
+// >n and <n compare the user count, C>n and C<n the channel age and T>n and
+// T<n the topic age, both in minutes
+func parseListFilter(param string) listFilter {
+	filter := listFilter{}
+	for _, item := range strings.Split(param, ",") {
+		if item == "" {
+			continue
+		}
+		if item[0] == '!' {
+			filter.notMasks = append(filter.notMasks, item[1:])
+			continue
+		}
+
+		field, op, value := "", item[0], item[1:]
+		if len(item) > 2 && (item[0] == 'C' || item[0] == 'T') && (item[1] == '<' || item[1] == '>') {
+			field, op, value = item[:1], item[1], item[2:]
+		}
+		n, err := strconv.Atoi(value)
+		if (op != '<' && op != '>') || err != nil {
+			filter.masks = append(filter.masks, item)
+			continue
+		}
+
+		less := op == '<'
+		switch field {
+		case "":
+			filter.conditions = append(filter.conditions, func(channel *models.Channel) bool {
+				return compareListValue(len(channel.Members), n, less)
+			})
+		case "C":
+			filter.conditions = append(filter.conditions, func(channel *models.Channel) bool {
+				return compareListValue(int(time.Since(channel.CreatedAt).Minutes()), n, less)
+			})
+		case "T":
+			filter.conditions = append(filter.conditions, func(channel *models.Channel) bool {
+				return channel.Topic != "" && compareListValue(int(time.Since(channel.TopicSetAt).Minutes()), n, less)
+			})
+		}
+	}
+	return filter
+}
+
+func compareListValue(value, limit int, less bool) bool {
+	if less {
+		return value < limit
+	}
+	return value > limit
+}
+
+func (f listFilter) matches(channel *models.Channel) bool {
+	if len(f.masks) > 0 {
+		matched := false
+		for _, mask := range f.masks {
+			if models.MatchMask(mask, channel.Name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, mask := range f.notMasks {
+		if models.MatchMask(mask, channel.Name) {
+			return false
+		}
+	}
+	for _, condition := range f.conditions {
+		if !condition(channel) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ph *ProtocolHandler) handleListCommand(user *models.User, params []string) ([]string, error) {
+	filter := listFilter{}
+	if len(params) > 0 {
+		filter = parseListFilter(params[0])
+	}
+
+	// ListChannels returns a snapshot, so the channel manager is not locked
+	// while the (possibly long) list is sent
+	ph.send(fmt.Sprintf(":%s 321 %s Channel :Users  Name", ph.stateManager.ServerName, user.Nickname))
+	for _, channel := range ph.stateManager.ChannelManager.ListChannels() {
+		if isHiddenChannel(channel) && !channel.HasMember(user.ID) {
+			continue
+		}
+		if !filter.matches(channel) {
+			continue
+		}
+		ph.send(fmt.Sprintf(":%s 322 %s %s %d :%s", ph.stateManager.ServerName, user.Nickname, channel.Name, len(channel.Members), channel.Topic))
+	}
+
+	return []string{fmt.Sprintf(":%s 323 %s :End of /LIST", ph.stateManager.ServerName, user.Nickname)}, nil
+}
+
+func (ph *ProtocolHandler) handleNamesCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 1 || params[0] == "" {
+		return []string{ph.stateManager.ChannelManager.EndOfNames(user, "*")}, nil
+	}
+
+	var replies []string
+	for _, channelName := range strings.Split(params[0], ",") {
+		channel, err := ph.stateManager.GetChannel(channelName)
+		if err != nil || (isHiddenChannel(channel) && !channel.HasMember(user.ID)) {
+			replies = append(replies, ph.stateManager.ChannelManager.EndOfNames(user, channelName))
+			continue
+		}
+		replies = append(replies, ph.stateManager.ChannelManager.NamesReplies(user, channel,
+			ph.HasCapability("multi-prefix"), ph.HasCapability("userhost-in-names"))...)
+	}
+	return replies, nil
+}
@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWhois(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #public,#secret")
+	alice.send("MODE #secret +s")
+	alice.send("AWAY :lunch")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+
+	lines := bob.send("WHOIS alice")
+	if got := findReply(lines, "311"); got != ":irc.test 311 bob alice alice localhost * :alice" {
+		t.Errorf("RPL_WHOISUSER = %q", got)
+	}
+	if got := findReply(lines, "319"); !strings.HasSuffix(got, " alice :@#public") {
+		t.Errorf("RPL_WHOISCHANNELS = %q, want #public without the secret channel", got)
+	}
+	if got := findReply(lines, "301"); !strings.HasSuffix(got, " alice :lunch") {
+		t.Errorf("RPL_AWAY = %q", got)
+	}
+	if got := findReply(lines, "317"); !strings.HasPrefix(got, ":irc.test 317 bob alice ") || !strings.HasSuffix(got, " :seconds idle, signon time") {
+		t.Errorf("RPL_WHOISIDLE = %q", got)
+	}
+	if hasReply(lines, "330") || hasReply(lines, "671") {
+		t.Errorf("WHOIS of a guest on plain text got %q", lines)
+	}
+	if last := lines[len(lines)-1]; last != ":irc.test 318 bob alice :End of /WHOIS list" {
+		t.Errorf("WHOIS ends with %q, want 318", last)
+	}
+
+	// WHOIS <server> <nick> is answered for the nickname
+	if lines := bob.send("WHOIS irc.test ALICE"); !hasReply(lines, "311") {
+		t.Errorf("WHOIS with a server got %q", lines)
+	}
+	lines = bob.send("WHOIS nobody")
+	if len(lines) != 2 || !hasReply(lines, "401") || !hasReply(lines, "318") {
+		t.Errorf("WHOIS of a missing nickname got %q, want 401 and 318", lines)
+	}
+	if lines := bob.send("WHOIS"); !hasReply(lines, "431") {
+		t.Errorf("WHOIS without a nickname got %q, want 431", lines)
+	}
+}
+
+func TestWhowas(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+
+	lines := bob.send("WHOWAS alice")
+	if len(lines) != 2 || !hasReply(lines, "406") || !hasReply(lines, "369") {
+		t.Errorf("WHOWAS of a nickname in use got %q, want 406 and 369", lines)
+	}
+
+	alice.send("NICK carol")
+	alice.send("NICK alice")
+	alice.send("NICK dave")
+	lines = bob.send("WHOWAS alice")
+	if got := strings.Count(strings.Join(lines, "\n"), " 314 bob alice alice localhost * :alice"); got != 2 {
+		t.Errorf("WHOWAS got %q, want both uses of the nickname", lines)
+	}
+	if lines := bob.send("WHOWAS alice 1"); strings.Count(strings.Join(lines, "\n"), " 314 ") != 1 {
+		t.Errorf("WHOWAS with a count got %q, want a single entry", lines)
+	}
+
+	// Quitting records the last nickname
+	alice.send("QUIT")
+	if lines := bob.send("WHOWAS dave"); !hasReply(lines, "314") || !hasReply(lines, "312") {
+		t.Errorf("WHOWAS after QUIT got %q", lines)
+	}
+}
+
+func TestList(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #big,#small,#secret,#private")
+	alice.send("MODE #secret +s")
+	alice.send("MODE #private +p")
+	alice.send("TOPIC #small :quiet here")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("JOIN #big")
+
+	// listed returns the channels of a LIST reply in order
+	listed := func(lines []string) string {
+		channels := []string{}
+		for _, line := range lines {
+			if fields := strings.Fields(line); len(fields) > 3 && fields[1] == "322" {
+				channels = append(channels, fields[3])
+			}
+		}
+		return strings.Join(channels, ",")
+	}
+
+	tests := []struct {
+		params string
+		want   string
+	}{
+		{"", "#big,#small"},
+		{"#big", "#big"},
+		{"#s*", "#small"},
+		{"!#b*", "#small"},
+		{">1", "#big"},
+		{"<2", "#small"},
+		{"C<5", "#big,#small"},
+		{"C>5", ""},
+		{"T<5", "#small"},
+		{"#big,#small,>1", "#big"},
+	}
+	for _, tt := range tests {
+		lines := bob.send(strings.TrimSpace("LIST " + tt.params))
+		if !hasReply(lines, "321") || lines[len(lines)-1] != ":irc.test 323 bob :End of /LIST" {
+			t.Errorf("LIST %s got %q, want 321 to 323", tt.params, lines)
+		}
+		if got := listed(lines); sortedList(got) != sortedList(tt.want) {
+			t.Errorf("LIST %s listed %q, want %q", tt.params, got, tt.want)
+		}
+	}
+
+	if got := findReply(bob.send("LIST #small"), "322"); got != ":irc.test 322 bob #small 1 :quiet here" {
+		t.Errorf("RPL_LIST = %q", got)
+	}
+
+	// Members see their own secret and private channels
+	if got := listed(alice.send("LIST")); sortedList(got) != "#big,#private,#secret,#small" {
+		t.Errorf("LIST from a member listed %q", got)
+	}
+}
+
+// sortedList sorts a comma-separated list, channels are listed in no
+// particular order
+func sortedList(list string) string {
+	items := strings.Split(list, ",")
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
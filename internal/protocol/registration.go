@@ -0,0 +1,250 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/exogmi/gossip/internal/models"
+	"github.com/exogmi/gossip/internal/state"
+)
+
+// saslChunkSize is the maximum length of an AUTHENTICATE payload. A chunk of
+// exactly this length means more data follows.
+const saslChunkSize = 400
+
+// registration holds what a client sent before completing registration
+type registration struct {
+	nickname       string
+	username       string
+	realname       string
+	password       string // Server password given with PASS
+	capNegotiating bool   // CAP LS or REQ was sent, registration waits for CAP END
+	account        string // Account authenticated with SASL
+	saslMechanism  string // Mechanism of the SASL exchange in progress
+	saslPayload    string
+}
+
+// IsRegistered reports whether the client completed connection registration
+func (ph *ProtocolHandler) IsRegistered() bool {
+	return ph.registered.Load()
+}
+
+// CloseReason returns why the connection must be closed once the replies to
+// the last command are sent, or "" to keep it open
+func (ph *ProtocolHandler) CloseReason() string {
+	return ph.closeReason
+}
+
+// clientName returns the nickname to address the client by in replies, which
+// is "*" until it has one
+func (ph *ProtocolHandler) clientName() string {
+	if ph.user != nil {
+		return ph.user.Nickname
+	}
+	if ph.registration.nickname != "" {
+		return ph.registration.nickname
+	}
+	return "*"
+}
+
+// allowedBeforeRegistration lists the commands accepted from clients that
+// have not completed registration
+func allowedBeforeRegistration(command string) bool {
+	switch command {
+	case "CAP", "PASS", "NICK", "USER", "AUTHENTICATE", "PING", "PONG", "QUIT":
+		return true
+	}
+	return false
+}
+
+func (ph *ProtocolHandler) handlePassCommand(params []string) ([]string, error) {
+	if ph.IsRegistered() {
+		return nil, errAlreadyRegistered()
+	}
+	if len(params) < 1 {
+		return nil, errNeedMoreParams("PASS")
+	}
+	ph.registration.password = params[0]
+	return nil, nil
+}
+
+// tryRegister completes registration once NICK and USER were both received
+// and capability negotiation is over
+func (ph *ProtocolHandler) tryRegister() ([]string, error) {
+	reg := &ph.registration
+	if ph.IsRegistered() || reg.nickname == "" || reg.username == "" || reg.capNegotiating {
+		return nil, nil
+	}
+
+	if password := ph.stateManager.Config.Password; password != "" &&
+		subtle.ConstantTimeCompare([]byte(reg.password), []byte(password)) != 1 {
+		ph.closeReason = "Bad password"
+		return nil, errPasswdMismatch()
+	}
+
+	// A nickname held by a user logged in to the same account belongs to a
+	// persistent user the client attaches to
+	if existing, err := ph.stateManager.GetUser(reg.nickname); err == nil {
+		if reg.account == "" || existing.Account != reg.account {
+			nickname := reg.nickname
+			reg.nickname = ""
+			return nil, errNicknameInUse(nickname)
+		}
+		return ph.attach(existing), nil
+	}
+
+	user, err := ph.stateManager.CreateUser(reg.nickname, reg.username, reg.realname, "localhost")
+	if err == state.ErrUserAlreadyExists {
+		nickname := reg.nickname
+		reg.nickname = ""
+		return nil, errNicknameInUse(nickname)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	user.Account = reg.account
+	user.Host = ph.accountHost(user)
+	ph.user = user
+	ph.registered.Store(true)
+	log.Printf("Registered user %s (username=%s, realname=%s)", user.Nickname, user.Username, user.Realname)
+
+	replies := ph.welcome()
+	ph.stateManager.Monitor.NotifyOnline(user)
+	return replies, nil
+}
+
+// attach registers the client as one more session of an existing user and
+// brings it up to date with the channels the user is in
+func (ph *ProtocolHandler) attach(user *models.User) []string {
+	wasOnline := ph.stateManager.Monitor.IsOnline(user)
+	wasDetached := user.SessionCount() == 0
+	ph.user = user
+	ph.registered.Store(true)
+	log.Printf("Attached a new client to user %s", user.Nickname)
+
+	replies := ph.welcome()
+	for _, channelName := range user.Channels {
+		channel, err := ph.stateManager.GetChannel(channelName)
+		if err != nil {
+			continue
+		}
+		replies = append(replies, user.JoinLine(channel.Name, ph.session))
+		if channel.Topic != "" {
+			replies = append(replies, ph.stateManager.ChannelManager.TopicReplies(user, channel)...)
+		}
+		names := ph.stateManager.ChannelManager.NamesBatch(user, channel, ph.session)
+		replies = append(replies, names.Lines(ph.HasCapability("batch"))...)
+	}
+
+	// Replay what was sent while no client was connected, a batch per target
+	if wasDetached {
+		for _, target := range append([]string{user.Nickname}, user.Channels...) {
+			history, err := ph.stateManager.MessageStore.HistoryBatch(ph.stateManager.ServerName, target, user.LastDisconnect)
+			if err != nil {
+				continue
+			}
+			replies = append(replies, history.Lines(ph.HasCapability("batch"))...)
+		}
+	}
+
+	if !wasOnline {
+		ph.stateManager.Monitor.NotifyOnline(user)
+	}
+	return replies
+}
+
+// welcome returns the burst of replies that completes registration
+func (ph *ProtocolHandler) welcome() []string {
+	welcomeMsg := []string{
+		fmt.Sprintf(":%s 001 %s :Welcome to the %s IRC Network %s!%s@%s",
+			ph.stateManager.ServerName, ph.user.Nickname, ph.stateManager.Config.NetworkName, ph.user.Nickname, ph.user.Username, ph.user.Host),
+		fmt.Sprintf(":%s 002 %s :Your host is %s, running version %s",
+			ph.stateManager.ServerName, ph.user.Nickname, ph.stateManager.ServerName, ServerVersion),
+		fmt.Sprintf(":%s 003 %s :This server was created %s",
+			ph.stateManager.ServerName, ph.user.Nickname, ph.stateManager.StartedAt.Format(time.RFC1123)),
+		fmt.Sprintf(":%s 004 %s %s %s %s %s %s",
+			ph.stateManager.ServerName, ph.user.Nickname, ph.stateManager.ServerName, ServerVersion, userModes, channelModes, channelModesWithParam),
+	}
+	welcomeMsg = append(welcomeMsg, ph.isupportReplies(ph.user)...)
+
+	// Clients expect the LUSERS and MOTD replies to end the burst
+	lusers, _ := ph.handleLusersCommand(ph.user, nil)
+	motd, _ := ph.handleMotdCommand(ph.user, nil)
+	welcomeMsg = append(welcomeMsg, lusers...)
+	return append(welcomeMsg, motd...)
+}
+
+// handleAuthenticateCommand runs a SASL PLAIN exchange, before or after
+// registration
+func (ph *ProtocolHandler) handleAuthenticateCommand(params []string) ([]string, error) {
+	reg := &ph.registration
+	name := ph.clientName()
+	fail := fmt.Sprintf(":%s 904 %s :SASL authentication failed", ph.stateManager.ServerName, name)
+
+	if !ph.HasCapability("sasl") {
+		return []string{fail}, nil
+	}
+	if len(params) < 1 || params[0] == "" {
+		return nil, errNeedMoreParams("AUTHENTICATE")
+	}
+	if reg.account != "" || (ph.user != nil && ph.user.Account != "") {
+		return []string{fmt.Sprintf(":%s 907 %s :You have already authenticated using SASL", ph.stateManager.ServerName, name)}, nil
+	}
+
+	if params[0] == "*" {
+		reg.saslMechanism, reg.saslPayload = "", ""
+		return []string{fmt.Sprintf(":%s 906 %s :SASL authentication aborted", ph.stateManager.ServerName, name)}, nil
+	}
+
+	if reg.saslMechanism == "" {
+		if strings.ToUpper(params[0]) != "PLAIN" {
+			return []string{fmt.Sprintf(":%s 908 %s PLAIN :are available SASL mechanisms", ph.stateManager.ServerName, name), fail}, nil
+		}
+		reg.saslMechanism = "PLAIN"
+		return []string{"AUTHENTICATE +"}, nil
+	}
+
+	chunk := params[0]
+	if len(chunk) > saslChunkSize || len(reg.saslPayload)+len(chunk) > 4*saslChunkSize {
+		reg.saslMechanism, reg.saslPayload = "", ""
+		return []string{fmt.Sprintf(":%s 905 %s :SASL message too long", ph.stateManager.ServerName, name)}, nil
+	}
+	if chunk != "+" {
+		reg.saslPayload += chunk
+	}
+	if len(chunk) == saslChunkSize {
+		return nil, nil
+	}
+
+	payload := reg.saslPayload
+	reg.saslMechanism, reg.saslPayload = "", ""
+
+	// PLAIN sends authzid NUL authcid NUL password
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return []string{fail}, nil
+	}
+	fields := strings.Split(string(decoded), "\x00")
+	if len(fields) != 3 || (fields[0] != "" && fields[0] != fields[1]) {
+		return []string{fail}, nil
+	}
+	account, err := ph.stateManager.AccountManager.Authenticate(fields[1], fields[2])
+	if err != nil {
+		log.Printf("SASL authentication failed for %s", fields[1])
+		return []string{fail}, nil
+	}
+
+	success := fmt.Sprintf(":%s 903 %s :SASL authentication successful", ph.stateManager.ServerName, name)
+	if ph.IsRegistered() {
+		return append(ph.login(ph.user, account.Name), success), nil
+	}
+	reg.account = account.Name
+	log.Printf("Client %s authenticated as %s", name, account.Name)
+	return []string{
+		fmt.Sprintf(":%s 900 %s %s!*@* %s :You are now logged in as %s", ph.stateManager.ServerName, name, name, account.Name, account.Name),
+		success,
+	}, nil
+}
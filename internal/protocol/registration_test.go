@@ -0,0 +1,244 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/exogmi/gossip/config"
+	"github.com/exogmi/gossip/internal/state"
+)
+
+func TestRegistrationRequired(t *testing.T) {
+	client := newTestClient(t, newTestState(t, nil))
+
+	for _, command := range []string{"JOIN #chan", "PRIVMSG alice :hi", "MODE alice +i"} {
+		if lines := client.send(command); !hasReply(lines, "451") {
+			t.Errorf("%s before registration got %q, want 451", command, lines)
+		}
+	}
+	if lines := client.send("PING token"); !hasReply(lines, "PONG") {
+		t.Errorf("PING before registration got %q, want PONG", lines)
+	}
+	if lines := client.register("alice"); !hasReply(lines, "001") {
+		t.Fatalf("Registration got %q, want 001", lines)
+	}
+	if lines := client.send("USER alice 0 * :alice"); !hasReply(lines, "462") {
+		t.Errorf("USER after registration got %q, want 462", lines)
+	}
+}
+
+func TestRegistrationPassword(t *testing.T) {
+	stateManager := newTestState(t, func(cfg *config.Config) { cfg.Password = "secret" })
+
+	client := newTestClient(t, stateManager)
+	client.send("PASS wrong")
+	lines := client.register("alice")
+	if !hasReply(lines, "464") || hasReply(lines, "001") {
+		t.Errorf("Registration with a wrong password got %q, want 464 only", lines)
+	}
+	if client.handler.CloseReason() == "" {
+		t.Error("A wrong password does not close the connection")
+	}
+	if _, err := stateManager.GetUser("alice"); err == nil {
+		t.Error("A wrong password registered the user")
+	}
+
+	client = newTestClient(t, stateManager)
+	if lines := client.register("alice"); !hasReply(lines, "464") {
+		t.Errorf("Registration without a password got %q, want 464", lines)
+	}
+
+	client = newTestClient(t, stateManager)
+	client.send("PASS secret")
+	if lines := client.register("alice"); !hasReply(lines, "001") {
+		t.Errorf("Registration with the password got %q, want 001", lines)
+	}
+	if reason := client.handler.CloseReason(); reason != "" {
+		t.Errorf("CloseReason() = %q, want none", reason)
+	}
+}
+
+func TestRegistrationCapEnd(t *testing.T) {
+	client := newTestClient(t, newTestState(t, nil))
+
+	if lines := client.send("CAP LS 302"); !hasReply(lines, "CAP") {
+		t.Fatalf("CAP LS got %q", lines)
+	}
+	if lines := client.register("alice"); len(lines) != 0 {
+		t.Errorf("Registration during capability negotiation got %q, want nothing", lines)
+	}
+	if lines := client.send("CAP REQ :batch"); !strings.Contains(findReply(lines, "CAP"), "ACK") {
+		t.Errorf("CAP REQ got %q, want ACK", lines)
+	}
+	if client.handler.IsRegistered() {
+		t.Fatal("Client registered before CAP END")
+	}
+	if lines := client.send("CAP END"); !hasReply(lines, "001") {
+		t.Errorf("CAP END got %q, want 001", lines)
+	}
+
+	// CAP REQ alone also holds registration until CAP END
+	client = newTestClient(t, newTestState(t, nil))
+	client.send("CAP REQ :batch")
+	if lines := client.register("bob"); hasReply(lines, "001") {
+		t.Errorf("Registration after CAP REQ got %q before CAP END", lines)
+	}
+	if lines := client.send("CAP END"); !hasReply(lines, "001") {
+		t.Errorf("CAP END got %q, want 001", lines)
+	}
+}
+
+// authenticate runs a SASL PLAIN exchange, sending the payload in chunks of
+// at most saslChunkSize bytes
+func (tc *testClient) authenticate(account, password string) []string {
+	tc.t.Helper()
+	if lines := tc.send("AUTHENTICATE PLAIN"); findReply(lines, "AUTHENTICATE") != "AUTHENTICATE +" {
+		return lines
+	}
+	payload := base64.StdEncoding.EncodeToString([]byte(account + "\x00" + account + "\x00" + password))
+	for {
+		chunk := payload
+		if len(chunk) > saslChunkSize {
+			chunk = chunk[:saslChunkSize]
+		}
+		payload = payload[len(chunk):]
+		lines := tc.send("AUTHENTICATE " + chunk)
+		if len(chunk) < saslChunkSize {
+			return lines
+		}
+		if len(lines) != 0 {
+			tc.t.Errorf("AUTHENTICATE with a full chunk got %q, want nothing", lines)
+		}
+		if payload == "" {
+			return tc.send("AUTHENTICATE +")
+		}
+	}
+}
+
+func TestSASLPlain(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	// 113+1+113+1+72 bytes encode to exactly one chunk of 400
+	account, password := strings.Repeat("a", 113), strings.Repeat("p", 72)
+	if _, err := stateManager.AccountManager.Register(account, password); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	client := newTestClient(t, stateManager)
+	if lines := client.authenticate(account, password); !hasReply(lines, "904") {
+		t.Errorf("AUTHENTICATE without the sasl capability got %q, want 904", lines)
+	}
+
+	client.send("CAP REQ :sasl")
+	client.send("NICK alice")
+	lines := client.authenticate(account, password)
+	if !hasReply(lines, "900") || !hasReply(lines, "903") {
+		t.Errorf("AUTHENTICATE with a 400 byte payload got %q, want 900 and 903", lines)
+	}
+	if lines := client.send("AUTHENTICATE PLAIN"); !hasReply(lines, "907") {
+		t.Errorf("AUTHENTICATE once authenticated got %q, want 907", lines)
+	}
+	client.send("USER alice 0 * :alice")
+	client.send("CAP END")
+	if user := client.handler.GetUser(); user == nil || user.Account != account {
+		t.Fatalf("Registered user %v is not logged in to %s", user, account)
+	}
+	if lines := client.send("AUTHENTICATE PLAIN"); !hasReply(lines, "907") {
+		t.Errorf("AUTHENTICATE after registration got %q, want 907", lines)
+	}
+
+	client = newTestClient(t, stateManager)
+	client.send("CAP REQ :sasl")
+	if lines := client.authenticate(account, "wrong"); !hasReply(lines, "904") {
+		t.Errorf("AUTHENTICATE with a wrong password got %q, want 904", lines)
+	}
+	client.send("AUTHENTICATE PLAIN")
+	if lines := client.send("AUTHENTICATE " + strings.Repeat("A", saslChunkSize+1)); !hasReply(lines, "905") {
+		t.Errorf("AUTHENTICATE with an oversized chunk got %q, want 905", lines)
+	}
+}
+
+func TestRegistrationReattach(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	for _, account := range []string{"alice", "bob"} {
+		if _, err := stateManager.AccountManager.Register(account, "password"); err != nil {
+			t.Fatalf("Register() error = %v", err)
+		}
+	}
+	login := func(account string) *testClient {
+		client := newTestClient(t, stateManager)
+		client.send("CAP REQ :sasl")
+		if lines := client.authenticate(account, "password"); !hasReply(lines, "903") {
+			t.Fatalf("AUTHENTICATE as %s got %q", account, lines)
+		}
+		return client
+	}
+
+	first := login("alice")
+	first.register("alice")
+	first.send("CAP END")
+	first.send("JOIN #chan")
+	user := first.handler.GetUser()
+
+	// Only a client logged in to the same account attaches to the user
+	for _, client := range []*testClient{newTestClient(t, stateManager), login("bob")} {
+		lines := append(client.register("alice"), client.send("CAP END")...)
+		if !hasReply(lines, "433") || hasReply(lines, "001") {
+			t.Errorf("Taking the nickname of another account got %q, want 433", lines)
+		}
+		if client.handler.GetUser() != nil {
+			t.Error("A client of another account was attached to the user")
+		}
+	}
+
+	second := login("alice")
+	second.register("alice")
+	lines := second.send("CAP END")
+	if !hasReply(lines, "001") || !hasReply(lines, "JOIN") {
+		t.Errorf("Reattaching got %q, want 001 and the channels of the user", lines)
+	}
+	if second.handler.GetUser() != user {
+		t.Error("The client was not attached to the existing user")
+	}
+	if count := user.SessionCount(); count != 2 {
+		t.Errorf("SessionCount() = %d, want 2", count)
+	}
+}
+
+func TestReservedNicknames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reserved")
+	if err := os.WriteFile(path, []byte("# reserved\nbad* No bad nicknames\nroot\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stateManager := newTestState(t, func(cfg *config.Config) { cfg.ReservedNicksFile = path })
+
+	client := newTestClient(t, stateManager)
+	tests := []struct {
+		nickname string
+		reason   string
+	}{
+		{"badger", "No bad nicknames"},
+		{"BADGER", "No bad nicknames"},
+		{"root", "Reserved nickname"},
+		{"NickServ", "Reserved for services"},
+		{"chanserv", "Reserved for services"},
+	}
+	for _, tt := range tests {
+		reply := findReply(client.send("NICK "+tt.nickname), "432")
+		if !strings.HasSuffix(reply, " "+tt.nickname+" :"+tt.reason) {
+			t.Errorf("NICK %s got %q, want 432 %s", tt.nickname, reply, tt.reason)
+		}
+	}
+
+	if lines := client.register("alice"); !hasReply(lines, "001") {
+		t.Fatalf("Registration got %q", lines)
+	}
+	if lines := client.send("NICK badly"); !hasReply(lines, "432") {
+		t.Errorf("NICK badly after registration got %q, want 432", lines)
+	}
+	if _, err := stateManager.GetUser("badly"); err != state.ErrUserNotFound {
+		t.Errorf("GetUser(badly) error = %v, want %v", err, state.ErrUserNotFound)
+	}
+}
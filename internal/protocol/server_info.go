@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+// ServerVersion is the version reported in the welcome burst and by VERSION
+const ServerVersion = "gossip-1.0"
+
+// checkServerTarget verifies the optional server parameter of informational
+// commands names this server
+func (ph *ProtocolHandler) checkServerTarget(params []string, index int) error {
+	if len(params) > index && params[index] != "" && !models.MatchMask(params[index], ph.stateManager.ServerName) {
+		return errNoSuchServer(params[index])
+	}
+	return nil
+}
+
+func (ph *ProtocolHandler) handleMotdCommand(user *models.User, params []string) ([]string, error) {
+	if err := ph.checkServerTarget(params, 0); err != nil {
+		return nil, err
+	}
+	lines := ph.stateManager.MOTD.Lines()
+	if len(lines) == 0 {
+		return nil, errNoMotd()
+	}
+
+	replies := []string{fmt.Sprintf(":%s 375 %s :- %s Message of the day - ", ph.stateManager.ServerName, user.Nickname, ph.stateManager.ServerName)}
+	for _, line := range lines {
+		replies = append(replies, fmt.Sprintf(":%s 372 %s :- %s", ph.stateManager.ServerName, user.Nickname, line))
+	}
+	return append(replies, fmt.Sprintf(":%s 376 %s :End of /MOTD command.", ph.stateManager.ServerName, user.Nickname)), nil
+}
+
+func (ph *ProtocolHandler) handleLusersCommand(user *models.User, params []string) ([]string, error) {
+	if err := ph.checkServerTarget(params, 1); err != nil {
+		return nil, err
+	}
+	users := ph.stateManager.UserManager.ListUsers()
+	currentUsers, maxUsers := ph.stateManager.UserManager.UserCount()
+
+	invisible, operators, sessions := 0, 0, 0
+	for _, u := range users {
+		if u.Modes.Invisible {
+			invisible++
+		}
+		if u.Modes.Operator {
+			operators++
+		}
+		sessions += u.SessionCount()
+	}
+
+	// Connections that are not attached to a user are still registering
+	unknown := ph.stateManager.ConnectionCount() - sessions
+	if unknown < 0 {
+		unknown = 0
+	}
+	channels := len(ph.stateManager.ChannelManager.ListChannels())
+
+	name, nick := ph.stateManager.ServerName, user.Nickname
+	replies := []string{fmt.Sprintf(":%s 251 %s :There are %d users and %d invisible on 1 servers", name, nick, len(users)-invisible, invisible)}
+	if operators > 0 {
+		replies = append(replies, fmt.Sprintf(":%s 252 %s %d :operator(s) online", name, nick, operators))
+	}
+	if unknown > 0 {
+		replies = append(replies, fmt.Sprintf(":%s 253 %s %d :unknown connection(s)", name, nick, unknown))
+	}
+	if channels > 0 {
+		replies = append(replies, fmt.Sprintf(":%s 254 %s %d :channels formed", name, nick, channels))
+	}
+	return append(replies,
+		fmt.Sprintf(":%s 255 %s :I have %d clients and 0 servers", name, nick, len(users)),
+		fmt.Sprintf(":%s 265 %s %d %d :Current local users %d, max %d", name, nick, currentUsers, maxUsers, currentUsers, maxUsers),
+		fmt.Sprintf(":%s 266 %s %d %d :Current global users %d, max %d", name, nick, currentUsers, maxUsers, currentUsers, maxUsers),
+	), nil
+}
+
+func (ph *ProtocolHandler) handleVersionCommand(user *models.User, params []string) ([]string, error) {
+	if err := ph.checkServerTarget(params, 0); err != nil {
+		return nil, err
+	}
+	replies := []string{fmt.Sprintf(":%s 351 %s %s %s :Gossip IRC server, built with %s",
+		ph.stateManager.ServerName, user.Nickname, ServerVersion, ph.stateManager.ServerName, runtime.Version())}
+	return append(replies, ph.isupportReplies(user)...), nil
+}
+
+func (ph *ProtocolHandler) handleTimeCommand(user *models.User, params []string) ([]string, error) {
+	if err := ph.checkServerTarget(params, 0); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return []string{fmt.Sprintf(":%s 391 %s %s %d 0 :%s", ph.stateManager.ServerName, user.Nickname,
+		ph.stateManager.ServerName, now.Unix(), now.Format(time.RFC1123))}, nil
+}
+
+func (ph *ProtocolHandler) handleAdminCommand(user *models.User, params []string) ([]string, error) {
+	if err := ph.checkServerTarget(params, 0); err != nil {
+		return nil, err
+	}
+	cfg := ph.stateManager.Config
+	if cfg.AdminName == "" && cfg.AdminLocation == "" && cfg.AdminEmail == "" {
+		return nil, errNoAdminInfo(ph.stateManager.ServerName)
+	}
+
+	return []string{
+		fmt.Sprintf(":%s 256 %s %s :Administrative info", ph.stateManager.ServerName, user.Nickname, ph.stateManager.ServerName),
+		fmt.Sprintf(":%s 257 %s :%s", ph.stateManager.ServerName, user.Nickname, cfg.AdminLocation),
+		fmt.Sprintf(":%s 258 %s :%s", ph.stateManager.ServerName, user.Nickname, cfg.AdminName),
+		fmt.Sprintf(":%s 259 %s :%s", ph.stateManager.ServerName, user.Nickname, cfg.AdminEmail),
+	}, nil
+}
+
+func (ph *ProtocolHandler) handleInfoCommand(user *models.User, params []string) ([]string, error) {
+	if err := ph.checkServerTarget(params, 0); err != nil {
+		return nil, err
+	}
+	lines := []string{
+		fmt.Sprintf("%s (%s)", ServerVersion, runtime.Version()),
+		"Gossip is an IRC server that keeps users connected while their",
+		"clients come and go, without the need for a bouncer.",
+		"",
+		fmt.Sprintf("On-line since %s", ph.stateManager.StartedAt.Format(time.RFC1123)),
+	}
+
+	replies := make([]string, 0, len(lines)+1)
+	for _, line := range lines {
+		replies = append(replies, fmt.Sprintf(":%s 371 %s :%s", ph.stateManager.ServerName, user.Nickname, line))
+	}
+	return append(replies, fmt.Sprintf(":%s 374 %s :End of /INFO list", ph.stateManager.ServerName, user.Nickname)), nil
+}
+
+// Modes listed in RPL_MYINFO and RPL_ISUPPORT. They must match what the MODE
+// handlers accept.
+const (
+	userModes             = "aio"
+	channelModes          = "abhikmnopqstv"
+	channelModesWithParam = "abhkoqv"
+	channelModeGroups     = "b,k,,imnpst" // CHANMODES: list, always, when set, never
+)
+
+// maxISupportTokens is the number of tokens sent per RPL_ISUPPORT line
+const maxISupportTokens = 13
+
+// isupportTokens returns the RPL_ISUPPORT tokens describing the server's
+// features and the limits its handlers enforce
+func (ph *ProtocolHandler) isupportTokens() []string {
+	cfg := ph.stateManager.Config
+	tokens := []string{
+		"NETWORK=" + cfg.NetworkName,
+		"CASEMAPPING=" + models.Casemapping(),
+		"CHANTYPES=" + channelTypes,
+		"CHANMODES=" + channelModeGroups,
+		"PREFIX=" + models.PrefixISupport(),
+		"MODES=1",
+		fmt.Sprintf("CHANLIMIT=%s:%d", channelTypes, cfg.MaxChannels),
+		fmt.Sprintf("NICKLEN=%d", cfg.NickLength),
+		fmt.Sprintf("CHANNELLEN=%d", cfg.ChannelLength),
+		fmt.Sprintf("TOPICLEN=%d", cfg.TopicLength),
+		fmt.Sprintf("KICKLEN=%d", cfg.KickLength),
+		fmt.Sprintf("AWAYLEN=%d", cfg.AwayLength),
+		fmt.Sprintf("NAMELEN=%d", cfg.NameLength),
+		fmt.Sprintf("MONITOR=%d", cfg.MonitorLimit),
+		fmt.Sprintf("MAXTARGETS=%d", cfg.MaxTargets),
+		fmt.Sprintf("TARGMAX=JOIN:,KICK:%d,NAMES:,NOTICE:%d,PART:,PRIVMSG:%d", cfg.MaxTargets, cfg.MaxTargets, cfg.MaxTargets),
+		"WHOX",
+		"ELIST=CMNTU",
+	}
+	if cfg.UTF8Only {
+		tokens = append(tokens, "UTF8ONLY")
+	}
+	return tokens
+}
+
+// isupportReplies returns the RPL_ISUPPORT lines advertising the server's
+// features
+func (ph *ProtocolHandler) isupportReplies(user *models.User) []string {
+	tokens := ph.isupportTokens()
+	replies := []string{}
+	for len(tokens) > 0 {
+		n := len(tokens)
+		if n > maxISupportTokens {
+			n = maxISupportTokens
+		}
+		replies = append(replies, fmt.Sprintf(":%s 005 %s %s :are supported by this server",
+			ph.stateManager.ServerName, user.Nickname, strings.Join(tokens[:n], " ")))
+		tokens = tokens[n:]
+	}
+	return replies
+}
+
+// truncate shortens s to at most maxLength bytes without splitting a UTF-8
+// sequence
+func truncate(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	for maxLength > 0 && !utf8.RuneStart(s[maxLength]) {
+		maxLength--
+	}
+	return s[:maxLength]
+}
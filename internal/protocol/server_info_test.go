@@ -0,0 +1,180 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/exogmi/gossip/config"
+)
+
+func TestMotd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd.txt")
+	if err := os.WriteFile(path, []byte("Welcome\r\nBe nice\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stateManager := newTestState(t, func(cfg *config.Config) { cfg.MOTDFile = path })
+	client := newTestClient(t, stateManager)
+
+	// The MOTD ends the registration burst
+	lines := client.register("alice")
+	if !hasReply(lines, "375") || lines[len(lines)-1] != ":irc.test 376 alice :End of /MOTD command." {
+		t.Errorf("Registration got %q, want the MOTD last", lines)
+	}
+
+	want := []string{
+		":irc.test 375 alice :- irc.test Message of the day - ",
+		":irc.test 372 alice :- Welcome",
+		":irc.test 372 alice :- Be nice",
+		":irc.test 376 alice :End of /MOTD command.",
+	}
+	if lines := client.send("MOTD"); strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("MOTD got %q, want %q", lines, want)
+	}
+
+	// The file is read again on reload
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := stateManager.MOTD.Load(); err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if lines := client.send("MOTD"); len(lines) != 1 || !hasReply(lines, "422") {
+		t.Errorf("MOTD after emptying the file got %q, want 422", lines)
+	}
+	if lines := client.send("MOTD other.server"); !hasReply(lines, "402") {
+		t.Errorf("MOTD for another server got %q, want 402", lines)
+	}
+}
+
+func TestLusers(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #chan")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("MODE bob +i")
+
+	lines := alice.send("LUSERS")
+	for _, want := range []string{
+		":irc.test 251 alice :There are 1 users and 1 invisible on 1 servers",
+		":irc.test 254 alice 1 :channels formed",
+		":irc.test 255 alice :I have 2 clients and 0 servers",
+		":irc.test 265 alice 2 2 :Current local users 2, max 2",
+	} {
+		if got := findReply(lines, strings.Fields(want)[1]); got != want {
+			t.Errorf("LUSERS got %q, want %q", got, want)
+		}
+	}
+	if hasReply(lines, "252") {
+		t.Errorf("LUSERS got %q, want no operators", lines)
+	}
+}
+
+func TestServerQueries(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	client := newTestClient(t, stateManager)
+	client.register("alice")
+
+	lines := client.send("VERSION")
+	if got := findReply(lines, "351"); !strings.HasPrefix(got, ":irc.test 351 alice "+ServerVersion+" irc.test :") {
+		t.Errorf("RPL_VERSION = %q", got)
+	}
+	if !hasReply(lines, "005") {
+		t.Errorf("VERSION got %q, want the ISUPPORT tokens", lines)
+	}
+	if got := findReply(client.send("TIME"), "391"); !strings.HasPrefix(got, ":irc.test 391 alice irc.test ") {
+		t.Errorf("RPL_TIME = %q", got)
+	}
+	if lines := client.send("INFO"); !hasReply(lines, "371") || lines[len(lines)-1] != ":irc.test 374 alice :End of /INFO list" {
+		t.Errorf("INFO got %q", lines)
+	}
+
+	// ADMIN needs contact information in the configuration
+	if lines := client.send("ADMIN"); !hasReply(lines, "423") {
+		t.Errorf("ADMIN without admin info got %q, want 423", lines)
+	}
+	stateManager.Config.AdminName = "Jo Admin"
+	stateManager.Config.AdminEmail = "admin@irc.test"
+	lines = client.send("ADMIN irc.test")
+	if got := findReply(lines, "258"); got != ":irc.test 258 alice :Jo Admin" {
+		t.Errorf("RPL_ADMINLOC2 = %q", got)
+	}
+	if got := findReply(lines, "259"); got != ":irc.test 259 alice :admin@irc.test" {
+		t.Errorf("RPL_ADMINEMAIL = %q", got)
+	}
+
+	for _, command := range []string{"VERSION", "TIME", "ADMIN", "INFO"} {
+		if lines := client.send(command + " other.server"); !hasReply(lines, "402") {
+			t.Errorf("%s for another server got %q, want 402", command, lines)
+		}
+	}
+}
+
+func TestISupport(t *testing.T) {
+	stateManager := newTestState(t, func(cfg *config.Config) {
+		cfg.NickLength = 5
+		cfg.ChannelLength = 8
+		cfg.TopicLength = 10
+		cfg.KickLength = 6
+		cfg.AwayLength = 5
+		cfg.MaxChannels = 2
+		cfg.MaxTargets = 2
+	})
+	alice := newTestClient(t, stateManager)
+	lines := alice.register("alice")
+
+	tokens := map[string]bool{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, ":irc.test 005 alice ") {
+			continue
+		}
+		line = strings.TrimPrefix(line, ":irc.test 005 alice ")
+		lineTokens := strings.Fields(strings.TrimSuffix(line, " :are supported by this server"))
+		if len(lineTokens) > maxISupportTokens {
+			t.Errorf("RPL_ISUPPORT %q has more than %d tokens", line, maxISupportTokens)
+		}
+		for _, token := range lineTokens {
+			tokens[token] = true
+		}
+	}
+	for _, want := range []string{
+		"NETWORK=Test", "CASEMAPPING=rfc1459", "CHANTYPES=#&", "PREFIX=(qaohv)~&@%+",
+		"NICKLEN=5", "CHANNELLEN=8", "TOPICLEN=10", "KICKLEN=6", "AWAYLEN=5",
+		"CHANLIMIT=#&:2", "MAXTARGETS=2", "MONITOR=100",
+	} {
+		if !tokens[want] {
+			t.Errorf("RPL_ISUPPORT is missing %s in %v", want, tokens)
+		}
+	}
+
+	// The handlers enforce the advertised limits
+	if lines := alice.send("NICK abcdef"); !hasReply(lines, "432") {
+		t.Errorf("NICK longer than NICKLEN got %q, want 432", lines)
+	}
+	if lines := alice.send("JOIN #abcdefgh"); !hasReply(lines, "479") {
+		t.Errorf("JOIN longer than CHANNELLEN got %q, want 479", lines)
+	}
+	if lines := alice.send("JOIN #a,#b,#c"); !hasReply(lines, "405") || alice.handler.GetUser().IsInChannel("#c") {
+		t.Errorf("JOIN beyond CHANLIMIT got %q, want 405", lines)
+	}
+	if lines := alice.send("PRIVMSG #a,#b,alice :hi"); len(lines) != 1 || !hasReply(lines, "407") {
+		t.Errorf("PRIVMSG beyond MAXTARGETS got %q, want 407", lines)
+	}
+	if got := findReply(alice.send("TOPIC #a :0123456789abc"), "TOPIC"); !strings.HasSuffix(got, " #a :0123456789") {
+		t.Errorf("TOPIC longer than TOPICLEN got %q, want it truncated", got)
+	}
+	alice.send("AWAY :abcdefgh")
+	if got := findReply(alice.send("WHOIS alice"), "301"); !strings.HasSuffix(got, " alice :abcde") {
+		t.Errorf("AWAY longer than AWAYLEN got %q, want it truncated", got)
+	}
+
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("JOIN #a")
+	if got := findReply(alice.send("KICK #a bob :abcdefghij"), "KICK"); !strings.HasSuffix(got, " #a bob :abcdef") {
+		t.Errorf("KICK longer than KICKLEN got %q, want the reason truncated", got)
+	}
+}
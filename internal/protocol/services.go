@@ -0,0 +1,335 @@
+package protocol
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/exogmi/gossip/internal/models"
+	"github.com/exogmi/gossip/internal/state"
+)
+
+// Names of the built-in services
+const (
+	NickServ = "NickServ"
+	ChanServ = "ChanServ"
+)
+
+// serviceFor returns the built-in service addressed by a PRIVMSG target, if any
+func serviceFor(target string) string {
+	for _, service := range []string{NickServ, ChanServ} {
+		if models.NamesEqual(target, service) {
+			return service
+		}
+	}
+	return ""
+}
+
+// secretCommands are the commands whose parameters may carry passwords
+var secretCommands = map[string]bool{"PASS": true, "AUTHENTICATE": true, "NICKSERV": true, "NS": true, "CHANSERV": true, "CS": true}
+
+// Redact returns a line fit for the logs. The parameters of commands that
+// may carry passwords, including messages to the services, are replaced.
+func Redact(line string) string {
+	msg, err := NewProtocolParser().Parse(line)
+	if err != nil || len(msg.Params) == 0 {
+		return line
+	}
+	if secretCommands[msg.Command] {
+		msg.Params = []string{"<redacted>"}
+		return msg.String()
+	}
+	if msg.Command == "PRIVMSG" || msg.Command == "NOTICE" {
+		for _, target := range strings.Split(msg.Params[0], ",") {
+			if serviceFor(target) != "" {
+				msg.Params = []string{msg.Params[0], "<redacted>"}
+				return msg.String()
+			}
+		}
+	}
+	return line
+}
+
+// handleServiceMessage handles a PRIVMSG sent to a built-in service
+func (ph *ProtocolHandler) handleServiceMessage(user *models.User, service, text string) ([]string, error) {
+	params := strings.Fields(text)
+	switch service {
+	case NickServ:
+		return ph.handleNickServCommand(user, params)
+	case ChanServ:
+		return ph.handleChanServCommand(user, params)
+	}
+	return nil, nil
+}
+
+func (ph *ProtocolHandler) serviceNotice(service string, user *models.User, format string, args ...interface{}) string {
+	return fmt.Sprintf(":%s NOTICE %s :%s", ph.stateManager.ServiceHostmask(service), user.Nickname, fmt.Sprintf(format, args...))
+}
+
+func (ph *ProtocolHandler) handleNickServCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 1 {
+		return []string{ph.serviceNotice(NickServ, user, "Syntax: REGISTER <password> | IDENTIFY [account] <password> | LOGOUT")}, nil
+	}
+
+	switch strings.ToUpper(params[0]) {
+	case "REGISTER":
+		if len(params) < 2 {
+			return []string{ph.serviceNotice(NickServ, user, "Syntax: REGISTER <password>")}, nil
+		}
+		if user.Account != "" {
+			return []string{ph.serviceNotice(NickServ, user, "You are already logged in as %s", user.Account)}, nil
+		}
+		account, err := ph.stateManager.AccountManager.Register(user.Nickname, params[1])
+		if err == state.ErrAccountAlreadyExists {
+			return []string{ph.serviceNotice(NickServ, user, "Account %s is already registered", user.Nickname)}, nil
+		} else if err == models.ErrPasswordTooLong {
+			return []string{ph.serviceNotice(NickServ, user, "Passwords may be at most %d bytes long", models.MaxPasswordLength)}, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to register account: %w", err)
+		}
+		log.Printf("User %s registered account %s", user.Nickname, account.Name)
+		return append([]string{ph.serviceNotice(NickServ, user, "Account %s registered", account.Name)}, ph.login(user, account.Name)...), nil
+	case "IDENTIFY":
+		if len(params) < 2 {
+			return []string{ph.serviceNotice(NickServ, user, "Syntax: IDENTIFY [account] <password>")}, nil
+		}
+		name, password := user.Nickname, params[1]
+		if len(params) > 2 {
+			name, password = params[1], params[2]
+		}
+		account, err := ph.stateManager.AccountManager.Authenticate(name, password)
+		if err != nil {
+			return []string{ph.serviceNotice(NickServ, user, "Invalid account name or password")}, nil
+		}
+		return ph.login(user, account.Name), nil
+	case "LOGOUT":
+		if user.Account == "" {
+			return []string{ph.serviceNotice(NickServ, user, "You are not logged in")}, nil
+		}
+		account := user.Account
+		user.Account = ""
+		log.Printf("User %s logged out of account %s", user.Nickname, account)
+		ph.revokeAccess(user, account)
+		replies := ph.updateHost(user)
+		replies = append(replies, fmt.Sprintf(":%s 901 %s %s :You are now logged out", ph.stateManager.ServerName, user.Nickname, user.Hostmask()))
+		return append(replies, ph.notifyAccount(user)...), nil
+	default:
+		return []string{ph.serviceNotice(NickServ, user, "Unknown command %s", params[0])}, nil
+	}
+}
+
+// login attaches the user to an account and grants the access it holds in
+// the registered channels the user is already in
+func (ph *ProtocolHandler) login(user *models.User, account string) []string {
+	user.Account = account
+	log.Printf("User %s logged in to account %s", user.Nickname, account)
+	replies := ph.updateHost(user)
+
+	for _, channelName := range user.Channels {
+		channel, err := ph.stateManager.ChannelManager.GetChannel(channelName)
+		if err != nil {
+			continue
+		}
+		ph.stateManager.ChannelManager.ApplyAccess(user, channel)
+	}
+
+	replies = append(replies, fmt.Sprintf(":%s 900 %s %s %s :You are now logged in as %s", ph.stateManager.ServerName, user.Nickname, user.Hostmask(), account, account))
+	return append(replies, ph.notifyAccount(user)...)
+}
+
+// revokeAccess takes back the privileges the account granted the user in the
+// registered channels they are in
+func (ph *ProtocolHandler) revokeAccess(user *models.User, account string) {
+	for _, channelName := range user.Channels {
+		channel, err := ph.stateManager.ChannelManager.GetChannel(channelName)
+		if err != nil {
+			continue
+		}
+		ph.stateManager.ChannelManager.RevokeAccess(user, channel, account)
+	}
+}
+
+// accountHost returns the host to show for a user, which depends on the
+// account they are logged in to
+func (ph *ProtocolHandler) accountHost(user *models.User) string {
+	template := ph.stateManager.Config.AccountHost
+	if user.Account == "" || template == "" {
+		return user.RealHost
+	}
+	return strings.ReplaceAll(template, "{account}", user.Account)
+}
+
+// updateHost gives the user the host of the account they logged in to or
+// out of, telling the sessions that negotiated chghost, and returns the
+// replies for the handler's own session
+func (ph *ProtocolHandler) updateHost(user *models.User) []string {
+	host := ph.accountHost(user)
+	if host == user.Host {
+		return nil
+	}
+	line := ph.stateManager.ChannelManager.ChangeHost(user, user.Username, host, ph.session)
+	var replies []string
+	if ph.HasCapability("chghost") {
+		replies = append(replies, models.TagAccount(line, user, ph.session))
+	}
+	return append(replies, fmt.Sprintf(":%s 396 %s %s :is now your displayed host", ph.stateManager.ServerName, user.Nickname, host))
+}
+
+// notifyAccount tells the sessions that negotiated account-notify and share
+// a channel with the user that they logged in or out, and returns the
+// notification for the handler's own session
+func (ph *ProtocolHandler) notifyAccount(user *models.User) []string {
+	account := user.Account
+	if account == "" {
+		account = "*"
+	}
+	line := fmt.Sprintf(":%s ACCOUNT %s", user.Hostmask(), account)
+	render := func(session models.ClientSession) string {
+		if !session.HasCapability("account-notify") {
+			return ""
+		}
+		return line
+	}
+	ph.stateManager.ChannelManager.SendToNeighbors(user, render, ph.session)
+
+	if !ph.HasCapability("account-notify") {
+		return nil
+	}
+	return []string{line}
+}
+
+func (ph *ProtocolHandler) handleChanServCommand(user *models.User, params []string) ([]string, error) {
+	if len(params) < 2 {
+		return []string{ph.serviceNotice(ChanServ, user, "Syntax: REGISTER|DROP|INFO <channel> | ACCESS <channel> LIST|ADD|DEL")}, nil
+	}
+
+	subCommand, channelName := strings.ToUpper(params[0]), params[1]
+	channel, err := ph.stateManager.GetChannel(channelName)
+	if err != nil {
+		return []string{ph.serviceNotice(ChanServ, user, "Channel %s does not exist", channelName)}, nil
+	}
+
+	switch subCommand {
+	case "REGISTER":
+		if user.Account == "" {
+			return []string{ph.serviceNotice(ChanServ, user, "You must be logged in to register a channel")}, nil
+		}
+		if !channel.IsAtLeast(user.ID, models.PrivilegeOp) {
+			return []string{ph.serviceNotice(ChanServ, user, "You must be a channel operator in %s to register it", channel.Name)}, nil
+		}
+		if _, err := ph.stateManager.ChannelManager.RegisterChannel(channel.Name, user.Account); err == state.ErrChannelAlreadyRegistered {
+			return []string{ph.serviceNotice(ChanServ, user, "Channel %s is already registered", channel.Name)}, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to register channel: %w", err)
+		}
+		ph.stateManager.ChannelManager.ApplyAccess(user, channel)
+		return []string{ph.serviceNotice(ChanServ, user, "Channel %s registered under account %s", channel.Name, user.Account)}, nil
+	case "DROP":
+		if channel.Registration == nil {
+			return []string{ph.serviceNotice(ChanServ, user, "Channel %s is not registered", channel.Name)}, nil
+		}
+		if !models.NamesEqual(user.Account, channel.Registration.Founder) {
+			return []string{ph.serviceNotice(ChanServ, user, "Only the founder of %s can drop it", channel.Name)}, nil
+		}
+		if err := ph.stateManager.ChannelManager.DropChannel(channel.Name); err != nil {
+			return nil, fmt.Errorf("failed to drop channel: %w", err)
+		}
+		return []string{ph.serviceNotice(ChanServ, user, "Channel %s has been dropped", channel.Name)}, nil
+	case "INFO":
+		if channel.Registration == nil {
+			return []string{ph.serviceNotice(ChanServ, user, "Channel %s is not registered", channel.Name)}, nil
+		}
+		return []string{ph.serviceNotice(ChanServ, user, "Channel %s: founder %s, registered %s",
+			channel.Name, channel.Registration.Founder, channel.Registration.RegisteredAt.Format(time.RFC1123))}, nil
+	case "ACCESS":
+		return ph.handleChanServAccess(user, channel, params[2:])
+	default:
+		return []string{ph.serviceNotice(ChanServ, user, "Unknown command %s", params[0])}, nil
+	}
+}
+
+func (ph *ProtocolHandler) handleChanServAccess(user *models.User, channel *models.Channel, params []string) ([]string, error) {
+	registration := channel.Registration
+	if registration == nil {
+		return []string{ph.serviceNotice(ChanServ, user, "Channel %s is not registered", channel.Name)}, nil
+	}
+	if len(params) < 1 {
+		return []string{ph.serviceNotice(ChanServ, user, "Syntax: ACCESS <channel> LIST | ADD <account> <level> | DEL <account>")}, nil
+	}
+
+	userLevel := registration.AccessLevel(user.Account)
+	switch strings.ToUpper(params[0]) {
+	case "LIST":
+		if userLevel == models.PrivilegeNone {
+			return []string{ph.serviceNotice(ChanServ, user, "You do not have access to %s", channel.Name)}, nil
+		}
+		// The access list is keyed by folded names, the accounts hold the
+		// names to show
+		accounts := make([]string, 0, len(registration.Access))
+		for key := range registration.Access {
+			if account, err := ph.stateManager.AccountManager.GetAccount(key); err == nil {
+				accounts = append(accounts, account.Name)
+			}
+		}
+		sort.Strings(accounts)
+		replies := []string{ph.serviceNotice(ChanServ, user, "Access list for %s:", channel.Name),
+			ph.serviceNotice(ChanServ, user, "  %s %s (founder)", registration.Founder, models.PrivilegeOwner)}
+		for _, account := range accounts {
+			replies = append(replies, ph.serviceNotice(ChanServ, user, "  %s %s", account, registration.Access[models.Fold(account)]))
+		}
+		return append(replies, ph.serviceNotice(ChanServ, user, "End of access list")), nil
+	case "ADD":
+		if len(params) < 3 {
+			return []string{ph.serviceNotice(ChanServ, user, "Syntax: ACCESS <channel> ADD <account> <level>")}, nil
+		}
+		account := params[1]
+		level, ok := models.ParsePrivilege(strings.ToLower(params[2]))
+		if !ok || level == models.PrivilegeOwner {
+			return []string{ph.serviceNotice(ChanServ, user, "Invalid level %s, use voice, halfop, op or admin", params[2])}, nil
+		}
+		if userLevel < models.PrivilegeAdmin || level > userLevel {
+			return []string{ph.serviceNotice(ChanServ, user, "You are not allowed to grant %s access in %s", level, channel.Name)}, nil
+		}
+		target, err := ph.stateManager.AccountManager.GetAccount(account)
+		if err != nil {
+			return []string{ph.serviceNotice(ChanServ, user, "Account %s does not exist", account)}, nil
+		}
+		account = target.Name
+		if models.NamesEqual(account, registration.Founder) {
+			return []string{ph.serviceNotice(ChanServ, user, "%s is the founder of %s", account, channel.Name)}, nil
+		}
+		registration.Access[models.Fold(account)] = level
+
+		// Members already in the channel get their new access right away
+		for _, member := range channel.Users() {
+			if models.NamesEqual(member.Account, account) {
+				ph.stateManager.ChannelManager.ApplyAccess(member, channel)
+			}
+		}
+		return []string{ph.serviceNotice(ChanServ, user, "%s added to the %s access list as %s", account, channel.Name, level)}, nil
+	case "DEL":
+		if len(params) < 2 {
+			return []string{ph.serviceNotice(ChanServ, user, "Syntax: ACCESS <channel> DEL <account>")}, nil
+		}
+		account := params[1]
+		level, exists := registration.Access[models.Fold(account)]
+		if !exists {
+			return []string{ph.serviceNotice(ChanServ, user, "%s is not on the %s access list", account, channel.Name)}, nil
+		}
+		if userLevel < models.PrivilegeAdmin || level > userLevel {
+			return []string{ph.serviceNotice(ChanServ, user, "You are not allowed to remove %s from %s", account, channel.Name)}, nil
+		}
+		// Members in the channel lose the access right away
+		for _, member := range channel.Users() {
+			if models.NamesEqual(member.Account, account) {
+				ph.stateManager.ChannelManager.RevokeAccess(member, channel, account)
+			}
+		}
+		delete(registration.Access, models.Fold(account))
+		return []string{ph.serviceNotice(ChanServ, user, "%s removed from the %s access list", account, channel.Name)}, nil
+	default:
+		return []string{ph.serviceNotice(ChanServ, user, "Unknown ACCESS command %s", params[0])}, nil
+	}
+}
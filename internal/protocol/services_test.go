@@ -0,0 +1,281 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/exogmi/gossip/config"
+	"github.com/exogmi/gossip/internal/models"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"PRIVMSG NickServ :IDENTIFY secret", "PRIVMSG NickServ <redacted>"},
+		{"PRIVMSG #chan,chanserv :REGISTER #chan", "PRIVMSG #chan,chanserv <redacted>"},
+		{":alice!alice@host PRIVMSG NickServ :REGISTER secret", ":alice!alice@host PRIVMSG NickServ <redacted>"},
+		{"NS IDENTIFY secret", "NS <redacted>"},
+		{"PASS secret", "PASS <redacted>"},
+		{"AUTHENTICATE AGFsaWNlAHNlY3JldA==", "AUTHENTICATE <redacted>"},
+		{"PRIVMSG #chan :hello there", "PRIVMSG #chan :hello there"},
+		{"JOIN #chan", "JOIN #chan"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.line); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLogoutRevokesAccess(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("NS REGISTER password")
+	alice.send("JOIN #chan")
+	alice.send("CS REGISTER #chan")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("NS REGISTER password")
+	bob.send("JOIN #chan")
+	alice.send("CS ACCESS #chan ADD bob op")
+
+	channel, err := stateManager.GetChannel("#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := bob.handler.GetUser()
+	if !channel.HasPrivilege(user.ID, models.PrivilegeOp) {
+		t.Fatal("ACCESS ADD did not op bob")
+	}
+	alice.session.take()
+
+	lines := bob.send("NS LOGOUT")
+	if !hasReply(lines, "901") {
+		t.Errorf("LOGOUT got %q, want 901", lines)
+	}
+	if channel.HasPrivilege(user.ID, models.PrivilegeOp) {
+		t.Error("LOGOUT kept the access list privilege")
+	}
+	want := ":ChanServ!ChanServ@services.irc.test MODE #chan -o bob"
+	if got := findReply(alice.session.take(), "MODE"); got != want {
+		t.Errorf("Channel members got %q, want %q", got, want)
+	}
+
+	// Logging in again grants it back
+	bob.send("NS IDENTIFY password")
+	if !channel.HasPrivilege(user.ID, models.PrivilegeOp) {
+		t.Error("IDENTIFY did not grant the access list privilege")
+	}
+}
+
+func TestAccountHost(t *testing.T) {
+	stateManager := newTestState(t, func(cfg *config.Config) { cfg.AccountHost = "{account}.users.test" })
+	alice := newTestClient(t, stateManager)
+	alice.send("CAP REQ :chghost")
+	alice.register("alice")
+	alice.send("CAP END")
+	alice.send("JOIN #chan")
+	bob := newTestClient(t, stateManager)
+	bob.send("CAP REQ :chghost")
+	bob.register("bob")
+	bob.send("CAP END")
+	bob.send("JOIN #chan")
+	carol := newTestClient(t, stateManager)
+	carol.register("carol")
+	carol.send("JOIN #chan")
+	bob.session.take()
+	carol.session.take()
+
+	lines := alice.send("NS REGISTER password")
+	want := ":alice!alice@localhost CHGHOST alice alice.users.test"
+	if got := findReply(lines, "CHGHOST"); got != want {
+		t.Errorf("Logging in sent %q, want %q", got, want)
+	}
+	if got := findReply(lines, "900"); !strings.Contains(got, " alice!alice@alice.users.test ") {
+		t.Errorf("Logging in got %q, want 900 with the account host", got)
+	}
+	if got := findReply(bob.session.take(), "CHGHOST"); got != want {
+		t.Errorf("Channel members with chghost got %q, want %q", got, want)
+	}
+	if got := carol.session.take(); hasReply(got, "CHGHOST") {
+		t.Errorf("Channel members without chghost got %q", got)
+	}
+
+	alice.send("NS LOGOUT")
+	want = ":alice!alice@alice.users.test CHGHOST alice localhost"
+	if got := findReply(bob.session.take(), "CHGHOST"); got != want {
+		t.Errorf("Logging out sent %q, want %q", got, want)
+	}
+
+	// A client logged in with SASL registers with the account host
+	dave := newTestClient(t, stateManager)
+	if _, err := stateManager.AccountManager.Register("dave", "password"); err != nil {
+		t.Fatal(err)
+	}
+	dave.send("CAP REQ :sasl")
+	dave.authenticate("dave", "password")
+	dave.register("dave")
+	if got := findReply(dave.send("CAP END"), "001"); !strings.HasSuffix(got, " dave!dave@dave.users.test") {
+		t.Errorf("Registration got %q, want the account host", got)
+	}
+}
+
+func TestAccessDelRevokesAccess(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("NS REGISTER password")
+	alice.send("JOIN #chan")
+	alice.send("CS REGISTER #chan")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	bob.send("NS REGISTER password")
+	bob.send("JOIN #chan")
+	alice.send("CS ACCESS #chan ADD bob halfop")
+
+	channel, err := stateManager.GetChannel("#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := bob.handler.GetUser()
+	if !channel.HasPrivilege(user.ID, models.PrivilegeHalfOp) {
+		t.Fatal("ACCESS ADD did not give bob halfop")
+	}
+	bob.session.take()
+
+	alice.send("CS ACCESS #chan DEL bob")
+	if channel.HasPrivilege(user.ID, models.PrivilegeHalfOp) {
+		t.Error("ACCESS DEL kept the access list privilege")
+	}
+	want := ":ChanServ!ChanServ@services.irc.test MODE #chan -h bob"
+	if got := findReply(bob.session.take(), "MODE"); got != want {
+		t.Errorf("Channel members got %q, want %q", got, want)
+	}
+}
+
+func TestAccountCasemapping(t *testing.T) {
+	stateManager := newTestState(t, func(cfg *config.Config) { cfg.Casemapping = models.CasemappingASCII })
+	if got := models.Casemapping(); got != models.CasemappingASCII {
+		t.Errorf("Casemapping() = %q, want the configured %q", got, models.CasemappingASCII)
+	}
+	stateManager = newTestState(t, nil)
+	if got := models.Casemapping(); got != models.CasemappingRFC1459 {
+		t.Errorf("Casemapping() = %q, want the configured %q", got, models.CasemappingRFC1459)
+	}
+
+	alice := newTestClient(t, stateManager)
+	alice.register("[alice]")
+	alice.send("NS REGISTER password")
+	alice.send("JOIN #chan")
+	alice.send("CS REGISTER #chan")
+	bob := newTestClient(t, stateManager)
+	bob.register("bob")
+	if lines := bob.send("NS REGISTER password"); !hasReply(lines, "900") {
+		t.Fatalf("NS REGISTER got %q", lines)
+	}
+	bob.send("JOIN #chan")
+
+	// Account names match under the casemapping
+	other := newTestClient(t, stateManager)
+	other.register("other")
+	if lines := other.send("NS REGISTER password"); !hasReply(lines, "900") {
+		t.Fatalf("NS REGISTER got %q", lines)
+	}
+	other.send("NS LOGOUT")
+	if lines := other.send("NS IDENTIFY {ALICE} password"); !hasReply(lines, "900") {
+		t.Errorf("IDENTIFY with the account name in another case got %q, want 900", lines)
+	}
+	if account := other.handler.GetUser().Account; account != "[alice]" {
+		t.Errorf("Logged in to %q, want [alice]", account)
+	}
+
+	// So do access list entries
+	alice.send("CS ACCESS #chan ADD BOB voice")
+	channel, err := stateManager.GetChannel("#chan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !channel.HasPrivilege(bob.handler.GetUser().ID, models.PrivilegeVoice) {
+		t.Error("ACCESS ADD with the account name in another case did not voice bob")
+	}
+	if got := channel.Registration.AccessLevel("Bob"); got != models.PrivilegeVoice {
+		t.Errorf("AccessLevel(Bob) = %v, want voice", got)
+	}
+	if lines := alice.send("CS ACCESS #chan LIST"); !strings.Contains(strings.Join(lines, "\n"), "  bob voice") {
+		t.Errorf("ACCESS LIST got %q, want bob listed as registered", lines)
+	}
+	alice.send("CS ACCESS #chan DEL Bob")
+	if got := channel.Registration.AccessLevel("bob"); got != models.PrivilegeNone {
+		t.Errorf("AccessLevel(bob) after DEL = %v, want none", got)
+	}
+	if lines := alice.send("PRIVMSG chanSERV :INFO #chan"); !strings.Contains(findReply(lines, "NOTICE"), "founder [alice]") {
+		t.Errorf("Messaging ChanServ in another case got %q", lines)
+	}
+}
+
+func TestAccountNotifications(t *testing.T) {
+	stateManager := newTestState(t, nil)
+	alice := newTestClient(t, stateManager)
+	alice.register("alice")
+	alice.send("JOIN #chan")
+	bob := newTestClient(t, stateManager)
+	bob.send("CAP REQ :account-notify account-tag extended-join setname")
+	bob.register("bob")
+	bob.send("CAP END")
+	bob.send("JOIN #chan")
+	carol := newTestClient(t, stateManager)
+	carol.register("carol")
+	carol.send("JOIN #chan")
+	bob.session.take()
+	carol.session.take()
+
+	alice.send("NS REGISTER password")
+	if got := findReply(bob.session.take(), "ACCOUNT"); got != ":alice!alice@localhost ACCOUNT alice" {
+		t.Errorf("Logging in sent %q to account-notify", got)
+	}
+	if got := carol.session.take(); hasReply(got, "ACCOUNT") {
+		t.Errorf("Channel members without account-notify got %q", got)
+	}
+
+	alice.send("PRIVMSG #chan :hi")
+	if got := bob.session.take(); len(got) != 1 || got[0] != "@account=alice :alice!alice@localhost PRIVMSG #chan :hi" {
+		t.Errorf("account-tag got %q", got)
+	}
+	if got := carol.session.take(); len(got) != 1 || got[0] != ":alice!alice@localhost PRIVMSG #chan :hi" {
+		t.Errorf("Channel members without account-tag got %q", got)
+	}
+
+	alice.send("PART #chan")
+	alice.send("JOIN #chan")
+	if got := findReply(bob.session.take(), "JOIN"); got != "@account=alice :alice!alice@localhost JOIN #chan alice :alice" {
+		t.Errorf("extended-join got %q", got)
+	}
+	if got := findReply(carol.session.take(), "JOIN"); got != ":alice!alice@localhost JOIN #chan" {
+		t.Errorf("Channel members without extended-join got %q", got)
+	}
+
+	// SETNAME reaches the channel members that negotiated setname
+	if lines := alice.send("SETNAME :Alice Liddell"); len(lines) != 0 {
+		t.Errorf("SETNAME without the capability got %q", lines)
+	}
+	if got := bob.session.take(); len(got) != 1 || got[0] != "@account=alice :alice!alice@localhost SETNAME :Alice Liddell" {
+		t.Errorf("setname got %q", got)
+	}
+	if got := carol.session.take(); len(got) != 0 {
+		t.Errorf("Channel members without setname got %q", got)
+	}
+	if got := findReply(bob.send("WHOIS alice"), "311"); !strings.HasSuffix(got, " :Alice Liddell") {
+		t.Errorf("WHOIS after SETNAME got %q", got)
+	}
+	if lines := alice.send("SETNAME :"); !hasReply(lines, "FAIL") {
+		t.Errorf("SETNAME with an empty realname got %q, want FAIL", lines)
+	}
+
+	alice.send("NS LOGOUT")
+	if got := findReply(bob.session.take(), "ACCOUNT"); got != ":alice!alice@localhost ACCOUNT *" {
+		t.Errorf("Logging out sent %q to account-notify", got)
+	}
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+var (
+	ErrAccountAlreadyExists = errors.New("account already exists")
+	ErrAccountNotFound      = errors.New("account not found")
+	ErrInvalidCredentials   = errors.New("invalid credentials")
+)
+
+type AccountManager struct {
+	accounts map[string]*models.Account // Key: account name folded by models.Fold
+	mu       sync.RWMutex
+}
+
+func NewAccountManager() *AccountManager {
+	return &AccountManager{
+		accounts: make(map[string]*models.Account),
+	}
+}
+
+// Register creates an account. The password is hashed without holding the
+// lock, since hashing is slow on purpose.
+func (am *AccountManager) Register(name, password string) (*models.Account, error) {
+	if am.AccountExists(name) {
+		return nil, ErrAccountAlreadyExists
+	}
+	account, err := models.NewAccount(name, password)
+	if err != nil {
+		return nil, err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	// The name may have been taken while the password was hashed
+	if _, exists := am.accounts[models.Fold(name)]; exists {
+		return nil, ErrAccountAlreadyExists
+	}
+	am.accounts[models.Fold(name)] = account
+	return account, nil
+}
+
+// Authenticate checks an account's password, without holding the lock
+func (am *AccountManager) Authenticate(name, password string) (*models.Account, error) {
+	account, err := am.GetAccount(name)
+	if err != nil || !account.CheckPassword(password) {
+		return nil, ErrInvalidCredentials
+	}
+	return account, nil
+}
+
+func (am *AccountManager) GetAccount(name string) (*models.Account, error) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	account, exists := am.accounts[models.Fold(name)]
+	if !exists {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+func (am *AccountManager) AccountExists(name string) bool {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	_, exists := am.accounts[models.Fold(name)]
+	return exists
+}
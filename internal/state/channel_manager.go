@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"regexp"
 	"strings"
 	"sync"
 
@@ -12,8 +11,14 @@ import (
 )
 
 var (
-	ErrChannelAlreadyExists = errors.New("channel already exists")
-	ErrChannelNotFound      = errors.New("channel not found")
+	ErrChannelAlreadyExists     = errors.New("channel already exists")
+	ErrChannelNotFound          = errors.New("channel not found")
+	ErrChannelAlreadyRegistered = errors.New("channel already registered")
+	ErrChannelNotRegistered     = errors.New("channel not registered")
+	ErrBadChannelKey            = errors.New("cannot join channel: incorrect key")
+	ErrBannedFromChannel        = errors.New("cannot join channel: you're banned")
+	ErrNotOnChannel             = errors.New("user is not on channel")
+	ErrInviteOnlyChannel        = errors.New("cannot join channel: invite only")
 )
 
 type ChannelManager struct {
@@ -35,13 +40,16 @@ func (cm *ChannelManager) CreateChannel(name string, creator *models.User) (*mod
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	if _, exists := cm.channels[name]; exists {
+	if _, exists := cm.channels[models.Fold(name)]; exists {
 		return nil, ErrChannelAlreadyExists
 	}
 
 	channel := models.NewChannel(name)
+	if defaultTopic := cm.stateManager.Config.DefaultTopic; defaultTopic != "" {
+		channel.SetTopic(strings.ReplaceAll(defaultTopic, "{channel}", name), cm.serverName)
+	}
 	channel.AddUser(creator)
-	cm.channels[name] = channel
+	cm.channels[models.Fold(name)] = channel
 	return channel, nil
 }
 
@@ -49,10 +57,10 @@ func (cm *ChannelManager) RemoveChannel(name string) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	if _, exists := cm.channels[name]; !exists {
+	if _, exists := cm.channels[models.Fold(name)]; !exists {
 		return ErrChannelNotFound
 	}
-	delete(cm.channels, name)
+	delete(cm.channels, models.Fold(name))
 	return nil
 }
 
@@ -60,7 +68,7 @@ func (cm *ChannelManager) GetChannel(name string) (*models.Channel, error) {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 
-	channel, exists := cm.channels[name]
+	channel, exists := cm.channels[models.Fold(name)]
 	if !exists {
 		return nil, ErrChannelNotFound
 	}
@@ -78,123 +86,335 @@ func (cm *ChannelManager) ListChannels() []*models.Channel {
 	return channels
 }
 
-func (cm *ChannelManager) JoinChannel(user *models.User, channelName string, key string) error {
+// JoinChannel adds a user to a channel and returns the replies for the
+// origin session, the one that sent the JOIN. The other members and the
+// user's other sessions are sent the join directly. A user already in the
+// channel is only answered, with what they missed since they disconnected.
+func (cm *ChannelManager) JoinChannel(user *models.User, channelName string, key string, origin models.ClientSession) ([]string, error) {
+	var out outbox
+	defer out.send() // once the lock is released
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	channel, exists := cm.channels[channelName]
+	channel, exists := cm.channels[models.Fold(channelName)]
 	if !exists {
-		return ErrChannelNotFound
+		return nil, ErrChannelNotFound
 	}
 
-	// Check if the channel has a key and if the provided key is correct
-	if channel.Key != "" && channel.Key != key {
-		return fmt.Errorf("cannot join channel: incorrect key")
-	}
+	wasInChannel := user.IsInChannel(channel.Name)
+	if !wasInChannel {
+		// Check if the channel has a key and if the provided key is correct
+		if channel.Key != "" && channel.Key != key {
+			return nil, ErrBadChannelKey
+		}
 
-	// Check if the user is banned
-	userMask := fmt.Sprintf("%s!%s@%s", user.Nickname, user.Username, user.Host)
-	for _, banMask := range channel.BanList {
-		if matchesMask(userMask, banMask) {
-			log.Printf("User %s attempted to join channel %s but is banned", user.Nickname, channelName)
-			return fmt.Errorf("cannot join channel: you're banned")
+		// Check if the user is banned
+		userMask := user.Hostmask()
+		for _, banMask := range channel.BanList {
+			if models.MatchMask(banMask, userMask) {
+				log.Printf("User %s attempted to join channel %s but is banned", user.Nickname, channel.Name)
+				return nil, ErrBannedFromChannel
+			}
+		}
+
+		// Invitations are single-use and required for invite-only channels,
+		// unless the user's account is on the channel's access list
+		invited := channel.UseInvite(user.ID)
+		hasAccess := channel.Registration != nil && channel.Registration.AccessLevel(user.Account) != models.PrivilegeNone
+		if channel.Modes.InviteOnly && !invited && !hasAccess {
+			return nil, ErrInviteOnlyChannel
 		}
-	}
 
-	wasInChannel := user.IsInChannel(channelName)
-	if !wasInChannel {
 		channel.AddUser(user)
-		user.JoinChannel(channelName)
+		user.JoinChannel(channel.Name)
 
-		// If this is the first user, make them an operator
-		if len(channel.Users) == 1 {
-			channel.Operators[user.Nickname] = true
+		// If this is the first user of an unregistered channel, make them an operator
+		if len(channel.Members) == 1 && channel.Registration == nil {
+			channel.SetPrivilege(user.ID, models.PrivilegeOp, true)
 		}
-	}
 
-	// Broadcast JOIN message to all users in the channel
-	joinMsg := fmt.Sprintf(":%s!%s@%s JOIN %s", user.Nickname, user.Username, user.Host, channelName)
-	for _, u := range channel.Users {
-		u.BroadcastToSessions(joinMsg)
+		// Broadcast JOIN message to all users in the channel
+		for _, u := range channel.Users() {
+			out.addUser(u, func(session models.ClientSession) string {
+				return user.JoinLine(channel.Name, session)
+			}, origin)
+		}
 	}
+	replies := []string{user.JoinLine(channel.Name, origin)}
 
-	// Send channel topic to the joining user
-	user.BroadcastToSessions(fmt.Sprintf(":%s 332 %s %s :%s", cm.serverName, user.Nickname, channelName, channel.Topic))
-	
-	// Send user list to the joining user
-	userList := channel.GetUserList()
-	user.BroadcastToSessions(fmt.Sprintf(":%s 353 %s = %s :%s", cm.serverName, user.Nickname, channelName, strings.Join(userList, " ")))
-	user.BroadcastToSessions(fmt.Sprintf(":%s 366 %s %s :End of /NAMES list", cm.serverName, user.Nickname, channelName))
+	// Grant the privileges the user's account holds in a registered channel
+	if modeMsg := cm.applyAccess(&out, user, channel, origin); modeMsg != "" {
+		replies = append(replies, modeMsg)
+	}
 
-	// Send updated user list to all users in the channel
-	for _, u := range channel.Users {
-		u.BroadcastToSessions(fmt.Sprintf(":%s 353 %s = %s :%s", cm.serverName, u.Nickname, channelName, strings.Join(userList, " ")))
-		u.BroadcastToSessions(fmt.Sprintf(":%s 366 %s %s :End of /NAMES list", cm.serverName, u.Nickname, channelName))
+	// Send the topic and user list to the joining sessions
+	for _, session := range user.Sessions() {
+		if session == origin || wasInChannel {
+			continue
+		}
+		if channel.Topic != "" {
+			for _, reply := range cm.TopicReplies(user, channel) {
+				out.add(session, reply)
+			}
+		}
+		out.addBatch(session, cm.NamesBatch(user, channel, session))
+	}
+	if channel.Topic != "" {
+		replies = append(replies, cm.TopicReplies(user, channel)...)
 	}
+	replies = append(replies, cm.NamesBatch(user, channel, origin).Lines(hasCapability(origin, "batch"))...)
 
 	// Replay missed messages if the user was already in the channel
 	if wasInChannel {
-		missedMessages, err := cm.stateManager.MessageStore.GetMessagesSince(channelName, user.LastDisconnect)
+		history, err := cm.stateManager.MessageStore.HistoryBatch(cm.serverName, channel.Name, user.LastDisconnect)
 		if err != nil {
-			log.Printf("Error retrieving missed messages for user %s in channel %s: %v", user.Nickname, channelName, err)
+			log.Printf("Error retrieving missed messages for user %s in channel %s: %v", user.Nickname, channel.Name, err)
 		} else {
-			for _, msg := range missedMessages {
-				formattedMsg := fmt.Sprintf(":%s!%s@%s PRIVMSG %s :%s", msg.Sender.Nickname, msg.Sender.Username, msg.Sender.Host, channelName, msg.Content)
-				user.BroadcastToSessions(formattedMsg)
-			}
+			replies = append(replies, history.Lines(hasCapability(origin, "batch"))...)
 		}
 	}
 
-	log.Printf("User %s joined channel %s", user.Nickname, channelName)
+	log.Printf("User %s joined channel %s", user.Nickname, channel.Name)
 
-	return nil
+	return replies, nil
+}
+
+// NamesBatch returns the NAMES replies of a channel for a session, honouring
+// its multi-prefix and userhost-in-names capabilities, as a batch
+func (cm *ChannelManager) NamesBatch(user *models.User, channel *models.Channel, session models.ClientSession) *models.Batch {
+	batch := models.NewBatch(cm.serverName, models.BatchNames, channel.Name)
+	batch.Add(cm.NamesReplies(user, channel, hasCapability(session, "multi-prefix"), hasCapability(session, "userhost-in-names"))...)
+	return batch
 }
 
-func matchesMask(str, mask string) bool {
-	// Simple wildcard matching
-	// This is a basic implementation and might need to be improved for more complex IRC mask matching
-	regexPattern := "^" + strings.ReplaceAll(strings.ReplaceAll(mask, ".", "\\."), "*", ".*") + "$"
-	matched, _ := regexp.MatchString(regexPattern, str)
-	return matched
+// hasCapability reports whether a session, which may be nil, negotiated a
+// capability
+func hasCapability(session models.ClientSession, name string) bool {
+	return session != nil && session.HasCapability(name)
+}
+
+// TopicReplies returns the RPL_TOPIC and RPL_TOPICWHOTIME replies describing
+// a channel's topic, or RPL_NOTOPIC when none is set
+func (cm *ChannelManager) TopicReplies(user *models.User, channel *models.Channel) []string {
+	if channel.Topic == "" {
+		return []string{fmt.Sprintf(":%s 331 %s %s :No topic is set", cm.serverName, user.Nickname, channel.Name)}
+	}
+	return []string{
+		fmt.Sprintf(":%s 332 %s %s :%s", cm.serverName, user.Nickname, channel.Name, channel.Topic),
+		fmt.Sprintf(":%s 333 %s %s %s %d", cm.serverName, user.Nickname, channel.Name, channel.TopicSetBy, channel.TopicSetAt.Unix()),
+	}
+}
+
+// NamesReplies returns the RPL_NAMREPLY lines listing a channel's members,
+// split so that no line exceeds the IRC line limit, and RPL_ENDOFNAMES
+func (cm *ChannelManager) NamesReplies(user *models.User, channel *models.Channel, multiPrefix, userhost bool) []string {
+	prefix := fmt.Sprintf(":%s 353 %s %s %s :", cm.serverName, user.Nickname, channel.Symbol(), channel.Name)
+	maxLength := models.MaxLineLength - len("\r\n")
+
+	var replies []string
+	line := prefix
+	for _, name := range channel.GetUserList(multiPrefix, userhost) {
+		if line != prefix && len(line)+1+len(name) > maxLength {
+			replies = append(replies, line)
+			line = prefix
+		}
+		if line != prefix {
+			line += " "
+		}
+		line += name
+	}
+	if line != prefix {
+		replies = append(replies, line)
+	}
+
+	return append(replies, cm.EndOfNames(user, channel.Name))
+}
+
+// EndOfNames returns the RPL_ENDOFNAMES reply for a channel
+func (cm *ChannelManager) EndOfNames(user *models.User, channelName string) string {
+	return fmt.Sprintf(":%s 366 %s %s :End of /NAMES list", cm.serverName, user.Nickname, channelName)
 }
 
 func (cm *ChannelManager) LeaveChannel(user *models.User, channelName string) error {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	channel, exists := cm.channels[channelName]
+	channel, exists := cm.channels[models.Fold(channelName)]
 	if !exists {
 		return ErrChannelNotFound
 	}
+	if !channel.HasMember(user.ID) {
+		return ErrNotOnChannel
+	}
 
-	channel.RemoveUser(user.Nickname)
+	channel.RemoveUser(user.ID)
 	user.LeaveChannel(channelName)
 
-	// Remove user from operators list if they were an operator
-	delete(channel.Operators, user.Nickname)
+	// If the channel is empty after the user leaves, remove it unless it is registered
+	if len(channel.Members) == 0 && channel.Registration == nil {
+		delete(cm.channels, models.Fold(channelName))
+	}
+
+	return nil
+}
+
+// InvitedChannels returns the channels a user holds a valid invitation to
+func (cm *ChannelManager) InvitedChannels(user *models.User) []*models.Channel {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	var invited []*models.Channel
+	for _, channel := range cm.channels {
+		if channel.IsInvited(user.ID) {
+			invited = append(invited, channel)
+		}
+	}
+	return invited
+}
+
+// RegisterChannel registers an existing channel to the founder account
+func (cm *ChannelManager) RegisterChannel(name, founder string) (*models.Channel, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 
-	// If the channel is empty after the user leaves, remove it
-	if len(channel.Users) == 0 {
-		delete(cm.channels, channelName)
+	channel, exists := cm.channels[models.Fold(name)]
+	if !exists {
+		return nil, ErrChannelNotFound
 	}
+	if channel.Registration != nil {
+		return nil, ErrChannelAlreadyRegistered
+	}
+	channel.Registration = models.NewChannelRegistration(founder)
+	log.Printf("Channel %s registered to account %s", name, founder)
+	return channel, nil
+}
+
+// DropChannel removes a channel's registration, deleting the channel if it is empty
+func (cm *ChannelManager) DropChannel(name string) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 
+	channel, exists := cm.channels[models.Fold(name)]
+	if !exists {
+		return ErrChannelNotFound
+	}
+	if channel.Registration == nil {
+		return ErrChannelNotRegistered
+	}
+	channel.Registration = nil
+	if len(channel.Members) == 0 {
+		delete(cm.channels, models.Fold(name))
+	}
+	log.Printf("Channel %s dropped", name)
 	return nil
 }
 
-func (cm *ChannelManager) BroadcastToChannel(channel *models.Channel, message *models.Message, exclude *models.User) {
+// ApplyAccess grants a member the privilege their account is entitled to in
+// a registered channel, e.g. after they identify
+func (cm *ChannelManager) ApplyAccess(user *models.User, channel *models.Channel) {
+	var out outbox
+	defer out.send()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.applyAccess(&out, user, channel, nil)
+}
+
+// applyAccess grants a member their access list privilege and queues the
+// mode change for every session but exclude. It returns the mode change, or
+// "" when there was nothing to grant.
+func (cm *ChannelManager) applyAccess(out *outbox, user *models.User, channel *models.Channel, exclude models.ClientSession) string {
+	if channel.Registration == nil || !channel.HasMember(user.ID) {
+		return ""
+	}
+	level := channel.Registration.AccessLevel(user.Account)
+	if level == models.PrivilegeNone || channel.HasPrivilege(user.ID, level) {
+		return ""
+	}
+	channel.SetPrivilege(user.ID, level, true)
+
+	modeMsg := fmt.Sprintf(":%s MODE %s +%s %s", cm.stateManager.ServiceHostmask("ChanServ"), channel.Name, level.ModeChar(), user.Nickname)
+	for _, u := range channel.Users() {
+		out.addUser(u, func(models.ClientSession) string { return modeMsg }, exclude)
+	}
+	return modeMsg
+}
+
+// RevokeAccess takes back from a member the privilege the account they
+// logged out of entitled them to in a registered channel
+func (cm *ChannelManager) RevokeAccess(user *models.User, channel *models.Channel, account string) {
+	var out outbox
+	defer out.send()
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if channel.Registration == nil || !channel.HasMember(user.ID) {
+		return
+	}
+	level := channel.Registration.AccessLevel(account)
+	if level == models.PrivilegeNone || !channel.HasPrivilege(user.ID, level) {
+		return
+	}
+	channel.SetPrivilege(user.ID, level, false)
+
+	modeMsg := fmt.Sprintf(":%s MODE %s -%s %s", cm.stateManager.ServiceHostmask("ChanServ"), channel.Name, level.ModeChar(), user.Nickname)
+	for _, u := range channel.Users() {
+		out.addUser(u, func(models.ClientSession) string { return modeMsg }, nil)
+	}
+}
+
+// BroadcastToChannel sends a message to every session of every member except
+// exclude, the session whose command caused it if it gets it as a reply
+func (cm *ChannelManager) BroadcastToChannel(channel *models.Channel, message *models.Message, exclude models.ClientSession) {
+	var out outbox
+	defer out.send()
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
 
-	for _, user := range channel.Users {
-		if user != exclude {
-			var formattedMsg string
-			switch message.Type {
-			case models.ChannelMessage:
-				formattedMsg = fmt.Sprintf(":%s!%s@%s PRIVMSG %s :%s", message.Sender.Nickname, message.Sender.Username, message.Sender.Host, channel.Name, message.Content)
-			case models.ServerMessage:
-				formattedMsg = message.Content
+	formattedMsg := message.IRCLine()
+	for _, user := range channel.Users() {
+		out.addUser(user, func(session models.ClientSession) string {
+			return models.TagAccount(formattedMsg, message.Sender, session)
+		}, exclude)
+	}
+}
+
+// SendToNeighbors renders and sends a line once to every session of the user
+// and of the users sharing a channel with them, except exclude. Sessions for
+// which render returns "" get nothing.
+func (cm *ChannelManager) SendToNeighbors(user *models.User, render func(session models.ClientSession) string, exclude models.ClientSession) {
+	var out outbox
+	defer out.send()
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	seen := map[*models.User]bool{user: true}
+	out.addUser(user, render, exclude)
+	for _, channelName := range user.Channels {
+		channel, exists := cm.channels[models.Fold(channelName)]
+		if !exists {
+			continue
+		}
+		for _, u := range channel.Users() {
+			if !seen[u] {
+				seen[u] = true
+				out.addUser(u, render, exclude)
 			}
-			user.BroadcastToSessions(formattedMsg)
 		}
 	}
 }
+
+// ChangeHost changes the username and host of a user, telling the sessions
+// but exclude that negotiated chghost and share a channel with the user. It
+// returns the CHGHOST line.
+func (cm *ChannelManager) ChangeHost(user *models.User, username, host string, exclude models.ClientSession) string {
+	line := fmt.Sprintf(":%s CHGHOST %s %s", user.Hostmask(), username, host)
+	user.Username, user.Host = username, host
+	cm.SendToNeighbors(user, func(session models.ClientSession) string {
+		if !session.HasCapability("chghost") {
+			return ""
+		}
+		return models.TagAccount(line, user, session)
+	}, exclude)
+	return line
+}
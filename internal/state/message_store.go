@@ -8,7 +8,7 @@ import (
 )
 
 type MessageStore struct {
-	messages    map[string][]*models.Message // Key: target (channel name or user nickname)
+	messages    map[string][]*models.Message // Key: folded target (channel name or user nickname)
 	maxMessages int                          // Maximum number of messages to store per target
 	mu          sync.RWMutex
 }
@@ -24,7 +24,7 @@ func (ms *MessageStore) StoreMessage(message *models.Message) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
-	target := message.Target
+	target := models.Fold(message.Target)
 	ms.messages[target] = append(ms.messages[target], message)
 
 	// Prune old messages if we've exceeded the maximum
@@ -39,7 +39,7 @@ func (ms *MessageStore) GetMessages(target string, limit int) ([]*models.Message
 	ms.mu.RLock()
 	defer ms.mu.RUnlock()
 
-	messages := ms.messages[target]
+	messages := ms.messages[models.Fold(target)]
 	if len(messages) < limit {
 		return messages, nil
 	}
@@ -51,7 +51,7 @@ func (ms *MessageStore) GetMessagesSince(target string, since time.Time) ([]*mod
 	defer ms.mu.RUnlock()
 
 	var missedMessages []*models.Message
-	for _, msg := range ms.messages[target] {
+	for _, msg := range ms.messages[models.Fold(target)] {
 		if msg.Timestamp.After(since) {
 			missedMessages = append(missedMessages, msg)
 		}
@@ -59,11 +59,45 @@ func (ms *MessageStore) GetMessagesSince(target string, since time.Time) ([]*mod
 	return missedMessages, nil
 }
 
+// HistoryBatch returns the messages sent to a target since a given time as
+// a chathistory batch opened by source
+func (ms *MessageStore) HistoryBatch(source, target string, since time.Time) (*models.Batch, error) {
+	messages, err := ms.GetMessagesSince(target, since)
+	if err != nil {
+		return nil, err
+	}
+	batch := models.NewBatch(source, models.BatchChatHistory, target)
+	for _, msg := range messages {
+		batch.Add(msg.IRCLine())
+	}
+	return batch, nil
+}
+
+// RenameTarget moves the history stored for oldTarget to newTarget, so a
+// user's private history follows them across nickname changes. History
+// left under newTarget by whoever used that nickname before is dropped
+// rather than shown to the new holder.
+func (ms *MessageStore) RenameTarget(oldTarget, newTarget string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	oldKey, newKey := models.Fold(oldTarget), models.Fold(newTarget)
+	if oldKey == newKey {
+		return
+	}
+	messages, exists := ms.messages[oldKey]
+	delete(ms.messages, oldKey)
+	delete(ms.messages, newKey)
+	if exists {
+		ms.messages[newKey] = messages
+	}
+}
+
 func (ms *MessageStore) ClearMessages(target string) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
-	delete(ms.messages, target)
+	delete(ms.messages, models.Fold(target))
 	return nil
 }
 
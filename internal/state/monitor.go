@@ -0,0 +1,140 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+// MonitorManager tracks the nicknames each user watches with MONITOR
+type MonitorManager struct {
+	watchers     map[string]map[string]*models.User // Key: folded nickname, then user ID
+	lists        map[string]map[string]string       // Key: user ID, then folded nickname, value: nickname as given
+	serverName   string
+	stateManager *StateManager
+	mu           sync.RWMutex
+}
+
+func NewMonitorManager(serverName string, stateManager *StateManager) *MonitorManager {
+	return &MonitorManager{
+		watchers:     make(map[string]map[string]*models.User),
+		lists:        make(map[string]map[string]string),
+		serverName:   serverName,
+		stateManager: stateManager,
+	}
+}
+
+func monitorKey(nickname string) string {
+	return models.Fold(nickname)
+}
+
+// Add adds a nickname to a user's watch list. It returns false when the list
+// already holds limit entries.
+func (mm *MonitorManager) Add(user *models.User, nickname string, limit int) bool {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	key := monitorKey(nickname)
+	list := mm.lists[user.ID]
+	if list == nil {
+		list = make(map[string]string)
+		mm.lists[user.ID] = list
+	}
+	if _, exists := list[key]; exists {
+		return true
+	}
+	if len(list) >= limit {
+		return false
+	}
+	list[key] = nickname
+
+	if mm.watchers[key] == nil {
+		mm.watchers[key] = make(map[string]*models.User)
+	}
+	mm.watchers[key][user.ID] = user
+	return true
+}
+
+// Remove removes a nickname from a user's watch list
+func (mm *MonitorManager) Remove(user *models.User, nickname string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.remove(user, monitorKey(nickname))
+}
+
+func (mm *MonitorManager) remove(user *models.User, key string) {
+	delete(mm.lists[user.ID], key)
+	if len(mm.lists[user.ID]) == 0 {
+		delete(mm.lists, user.ID)
+	}
+	delete(mm.watchers[key], user.ID)
+	if len(mm.watchers[key]) == 0 {
+		delete(mm.watchers, key)
+	}
+}
+
+// Clear empties a user's watch list
+func (mm *MonitorManager) Clear(user *models.User) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for key := range mm.lists[user.ID] {
+		mm.remove(user, key)
+	}
+}
+
+// List returns the nicknames a user watches
+func (mm *MonitorManager) List(user *models.User) []string {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	nicknames := make([]string, 0, len(mm.lists[user.ID]))
+	for _, nickname := range mm.lists[user.ID] {
+		nicknames = append(nicknames, nickname)
+	}
+	return nicknames
+}
+
+// IsOnline reports whether a user counts as online for MONITOR. Users
+// without any connected client only do if the server is configured so.
+func (mm *MonitorManager) IsOnline(user *models.User) bool {
+	return user.SessionCount() > 0 || mm.stateManager.Config.MonitorDetachedOnline
+}
+
+// NotifyOnline sends RPL_MONONLINE for a user to everyone watching their nickname
+func (mm *MonitorManager) NotifyOnline(user *models.User) {
+	for _, watcher := range mm.watchersOf(user.Nickname) {
+		watcher.BroadcastToSessions(fmt.Sprintf(":%s 730 %s :%s", mm.serverName, watcher.Nickname, user.Hostmask()))
+	}
+}
+
+// NotifyOffline sends RPL_MONOFFLINE for a nickname to everyone watching it
+func (mm *MonitorManager) NotifyOffline(nickname string) {
+	for _, watcher := range mm.watchersOf(nickname) {
+		watcher.BroadcastToSessions(fmt.Sprintf(":%s 731 %s :%s", mm.serverName, watcher.Nickname, nickname))
+	}
+}
+
+// SessionDetached notifies watchers when a user's last client disconnects,
+// unless detached users still count as online
+func (mm *MonitorManager) SessionDetached(user *models.User) {
+	if user.SessionCount() > 0 || mm.stateManager.Config.MonitorDetachedOnline {
+		return
+	}
+	// Users who quit are gone already and have been reported offline
+	if current, err := mm.stateManager.GetUser(user.Nickname); err != nil || current != user {
+		return
+	}
+	mm.NotifyOffline(user.Nickname)
+}
+
+func (mm *MonitorManager) watchersOf(nickname string) []*models.User {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+
+	watchers := make([]*models.User, 0, len(mm.watchers[monitorKey(nickname)]))
+	for _, watcher := range mm.watchers[monitorKey(nickname)] {
+		watchers = append(watchers, watcher)
+	}
+	return watchers
+}
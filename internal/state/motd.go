@@ -0,0 +1,53 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MOTD holds the message of the day, read from a file so that it can be
+// reloaded while the server is running
+type MOTD struct {
+	path  string
+	lines []string
+	mu    sync.RWMutex
+}
+
+func NewMOTD(path string) *MOTD {
+	return &MOTD{path: path}
+}
+
+// Load (re)reads the MOTD file. Without a configured file the MOTD is empty.
+func (m *MOTD) Load() error {
+	var lines []string
+	if m.path != "" {
+		file, err := os.Open(m.path)
+		if err != nil {
+			return fmt.Errorf("failed to open MOTD file: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read MOTD file: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lines = lines
+	return nil
+}
+
+// Lines returns the lines of the MOTD, or nil when there is none
+func (m *MOTD) Lines() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lines
+}
@@ -0,0 +1,48 @@
+package state
+
+import "github.com/exogmi/gossip/internal/models"
+
+// outbox collects lines for client sessions while a lock is held, to send
+// them once it is released: sending may block on a slow client for seconds
+type outbox []delivery
+
+// delivery is a line or a batch of lines for a session
+type delivery struct {
+	session models.ClientSession
+	line    string
+	batch   *models.Batch
+}
+
+// add queues a line for a session
+func (o *outbox) add(session models.ClientSession, line string) {
+	if line != "" {
+		*o = append(*o, delivery{session: session, line: line})
+	}
+}
+
+// addBatch queues a batch for a session
+func (o *outbox) addBatch(session models.ClientSession, batch *models.Batch) {
+	*o = append(*o, delivery{session: session, batch: batch})
+}
+
+// addUser renders and queues a line for every session of a user except
+// exclude. Sessions for which render returns "" get nothing.
+func (o *outbox) addUser(user *models.User, render func(session models.ClientSession) string, exclude models.ClientSession) {
+	for _, session := range user.Sessions() {
+		if session != exclude {
+			o.add(session, render(session))
+		}
+	}
+}
+
+// send sends the queued lines, in order
+func (o *outbox) send() {
+	for _, d := range *o {
+		if d.batch != nil {
+			d.session.SendBatch(d.batch)
+		} else {
+			d.session.SendMessage(d.line)
+		}
+	}
+	*o = nil
+}
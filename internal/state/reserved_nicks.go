@@ -0,0 +1,81 @@
+package state
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+// defaultReservedReason is given for patterns listed without a reason
+const defaultReservedReason = "Reserved nickname"
+
+// ReservedNick is a nickname pattern (Q-line) no user may take
+type ReservedNick struct {
+	Mask   string
+	Reason string
+}
+
+// ReservedNicks holds the server-wide reserved nickname patterns, read from a
+// file so that they can be reloaded while the server is running
+type ReservedNicks struct {
+	path    string
+	entries []ReservedNick
+	mu      sync.RWMutex
+}
+
+func NewReservedNicks(path string) *ReservedNicks {
+	return &ReservedNicks{path: path}
+}
+
+// Load (re)reads the reserved nicknames file. Each line holds a nickname
+// mask followed by the reason it is reserved, blank lines and lines starting
+// with # are ignored. Without a configured file no nickname is reserved.
+func (rn *ReservedNicks) Load() error {
+	var entries []ReservedNick
+	if rn.path != "" {
+		file, err := os.Open(rn.path)
+		if err != nil {
+			return fmt.Errorf("failed to open reserved nicknames file: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			mask, reason, _ := strings.Cut(line, " ")
+			reason = strings.TrimSpace(reason)
+			if reason == "" {
+				reason = defaultReservedReason
+			}
+			entries = append(entries, ReservedNick{Mask: mask, Reason: reason})
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read reserved nicknames file: %w", err)
+		}
+	}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.entries = entries
+	return nil
+}
+
+// Match returns the reason a nickname is reserved, or "" if it is not
+func (rn *ReservedNicks) Match(nickname string) string {
+	rn.mu.RLock()
+	defer rn.mu.RUnlock()
+
+	for _, entry := range rn.entries {
+		if models.MatchMask(entry.Mask, nickname) {
+			return entry.Reason
+		}
+	}
+	return ""
+}
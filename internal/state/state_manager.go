@@ -1,31 +1,81 @@
 package state
 
 import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
 	"github.com/exogmi/gossip/config"
 	"github.com/exogmi/gossip/internal/models"
 )
 
+// whowasHistorySize is the number of entries kept for WHOWAS
+const whowasHistorySize = 1000
+
 // StateManager serves as the central point for accessing all state-related operations
 type StateManager struct {
 	UserManager    *UserManager
 	ChannelManager *ChannelManager
+	AccountManager *AccountManager
+	Monitor        *MonitorManager
 	MessageStore   *MessageStore
+	Whowas         *WhowasHistory
+	MOTD           *MOTD
+	ReservedNicks  *ReservedNicks
 	ServerName     string
 	Verbosity      config.VerbosityLevel
+	Config         *config.Config
+	StartedAt      time.Time
+	connections    int32
 }
 
 // NewStateManager creates a new StateManager instance
-func NewStateManager(userManager *UserManager, messageStore *MessageStore, serverName string, verbosity config.VerbosityLevel) *StateManager {
+func NewStateManager(userManager *UserManager, messageStore *MessageStore, cfg *config.Config) *StateManager {
 	sm := &StateManager{
-		UserManager:  userManager,
-		MessageStore: messageStore,
-		ServerName:   serverName,
-		Verbosity:    verbosity,
+		UserManager:    userManager,
+		AccountManager: NewAccountManager(),
+		MessageStore:   messageStore,
+		Whowas:         NewWhowasHistory(whowasHistorySize),
+		MOTD:           NewMOTD(cfg.MOTDFile),
+		ReservedNicks:  NewReservedNicks(cfg.ReservedNicksFile),
+		ServerName:     cfg.ServerName,
+		Verbosity:      cfg.Verbosity,
+		Config:         cfg,
+		StartedAt:      time.Now(),
+	}
+	if cfg.Casemapping != "" {
+		if err := models.SetCasemapping(cfg.Casemapping); err != nil {
+			log.Printf("Failed to set casemapping: %v", err)
+		}
+	}
+	sm.ChannelManager = NewChannelManager(cfg.ServerName, sm)
+	sm.Monitor = NewMonitorManager(cfg.ServerName, sm)
+	if err := sm.MOTD.Load(); err != nil {
+		log.Printf("Failed to load MOTD: %v", err)
+	}
+	if err := sm.ReservedNicks.Load(); err != nil {
+		log.Printf("Failed to load reserved nicknames: %v", err)
 	}
-	sm.ChannelManager = NewChannelManager(serverName, sm)
 	return sm
 }
 
+// ConnectionOpened records a new client connection
+func (sm *StateManager) ConnectionOpened() {
+	atomic.AddInt32(&sm.connections, 1)
+}
+
+// ConnectionClosed records the end of a client connection
+func (sm *StateManager) ConnectionClosed() {
+	atomic.AddInt32(&sm.connections, -1)
+}
+
+// ConnectionCount returns the number of open client connections, registered
+// or not
+func (sm *StateManager) ConnectionCount() int {
+	return int(atomic.LoadInt32(&sm.connections))
+}
+
 // GetUser retrieves a user by nickname
 func (sm *StateManager) GetUser(nickname string) (*models.User, error) {
 	return sm.UserManager.GetUser(nickname)
@@ -51,6 +101,12 @@ func (sm *StateManager) CreateChannel(name string, creator *models.User) (*model
 	return sm.ChannelManager.CreateChannel(name, creator)
 }
 
+// ServiceHostmask returns the hostmask used for messages sent by a built-in
+// service such as ChanServ
+func (sm *StateManager) ServiceHostmask(service string) string {
+	return fmt.Sprintf("%s!%s@services.%s", service, service, sm.ServerName)
+}
+
 // StoreMessage stores a message
 func (sm *StateManager) StoreMessage(message *models.Message) error {
 	return sm.MessageStore.StoreMessage(message)
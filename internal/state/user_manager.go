@@ -13,8 +13,9 @@ var (
 )
 
 type UserManager struct {
-	users map[string]*models.User // Key: nickname
-	mu    sync.RWMutex
+	users    map[string]*models.User // Key: folded nickname
+	maxUsers int                     // Highest number of users seen at once
+	mu       sync.RWMutex
 }
 
 func NewUserManager() *UserManager {
@@ -27,10 +28,13 @@ func (um *UserManager) AddUser(user *models.User) error {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	if _, exists := um.users[user.Nickname]; exists {
+	if _, exists := um.users[models.Fold(user.Nickname)]; exists {
 		return ErrUserAlreadyExists
 	}
-	um.users[user.Nickname] = user
+	um.users[models.Fold(user.Nickname)] = user
+	if len(um.users) > um.maxUsers {
+		um.maxUsers = len(um.users)
+	}
 	return nil
 }
 
@@ -38,10 +42,10 @@ func (um *UserManager) RemoveUser(nickname string) error {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	if _, exists := um.users[nickname]; !exists {
+	if _, exists := um.users[models.Fold(nickname)]; !exists {
 		return ErrUserNotFound
 	}
-	delete(um.users, nickname)
+	delete(um.users, models.Fold(nickname))
 	return nil
 }
 
@@ -49,7 +53,7 @@ func (um *UserManager) GetUser(nickname string) (*models.User, error) {
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 
-	user, exists := um.users[nickname]
+	user, exists := um.users[models.Fold(nickname)]
 	if !exists {
 		return nil, ErrUserNotFound
 	}
@@ -60,10 +64,10 @@ func (um *UserManager) UpdateUser(user *models.User) error {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	if _, exists := um.users[user.Nickname]; !exists {
+	if _, exists := um.users[models.Fold(user.Nickname)]; !exists {
 		return ErrUserNotFound
 	}
-	um.users[user.Nickname] = user
+	um.users[models.Fold(user.Nickname)] = user
 	return nil
 }
 
@@ -78,11 +82,19 @@ func (um *UserManager) ListUsers() []*models.User {
 	return users
 }
 
+// UserCount returns the current number of users and the highest number seen
+// since the server started
+func (um *UserManager) UserCount() (current, max int) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	return len(um.users), um.maxUsers
+}
+
 func (um *UserManager) UserExists(nickname string) bool {
 	um.mu.RLock()
 	defer um.mu.RUnlock()
 
-	_, exists := um.users[nickname]
+	_, exists := um.users[models.Fold(nickname)]
 	return exists
 }
 
@@ -90,17 +102,18 @@ func (um *UserManager) ChangeNickname(oldNick, newNick string) error {
 	um.mu.Lock()
 	defer um.mu.Unlock()
 
-	user, exists := um.users[oldNick]
+	user, exists := um.users[models.Fold(oldNick)]
 	if !exists {
 		return ErrUserNotFound
 	}
 
-	if _, exists := um.users[newNick]; exists {
+	// A change of case only keeps the same key
+	if existing, exists := um.users[models.Fold(newNick)]; exists && existing != user {
 		return ErrUserAlreadyExists
 	}
 
-	delete(um.users, oldNick)
+	delete(um.users, models.Fold(oldNick))
 	user.Nickname = newNick
-	um.users[newNick] = user
+	um.users[models.Fold(newNick)] = user
 	return nil
 }
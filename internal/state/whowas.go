@@ -0,0 +1,52 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/exogmi/gossip/internal/models"
+)
+
+// WhowasHistory keeps a bounded history of nicknames that were given up
+// through NICK or QUIT
+type WhowasHistory struct {
+	entries    []models.WhowasEntry // Oldest first
+	maxEntries int
+	mu         sync.RWMutex
+}
+
+func NewWhowasHistory(maxEntries int) *WhowasHistory {
+	return &WhowasHistory{
+		entries:    make([]models.WhowasEntry, 0),
+		maxEntries: maxEntries,
+	}
+}
+
+// Record adds a snapshot of the user under their current nickname
+func (wh *WhowasHistory) Record(user *models.User) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	wh.entries = append(wh.entries, user.WhowasEntry())
+	if len(wh.entries) > wh.maxEntries {
+		wh.entries = wh.entries[len(wh.entries)-wh.maxEntries:]
+	}
+}
+
+// Lookup returns up to count entries for a nickname, most recent first. A
+// count of zero or less returns every entry.
+func (wh *WhowasHistory) Lookup(nickname string, count int) []models.WhowasEntry {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+
+	var found []models.WhowasEntry
+	for i := len(wh.entries) - 1; i >= 0; i-- {
+		if !models.NamesEqual(wh.entries[i].Nickname, nickname) {
+			continue
+		}
+		found = append(found, wh.entries[i])
+		if count > 0 && len(found) == count {
+			break
+		}
+	}
+	return found
+}